@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the default value of the "ma" parameter, see RFC 7838 section 3.1
+	defaultAltSvcMaxAge = 24 * time.Hour
+)
+
+// altSvc is an alternative service advertised via the Alt-Svc header
+type altSvc struct {
+	protocol string
+	host     string
+	port     string
+	maxAge   time.Duration
+	// the "v" parameter used by gQUIC to list the supported versions
+	versions string
+}
+
+func (as *altSvc) String() string {
+	return fmt.Sprintf(`%s="%s"`, as.protocol, net.JoinHostPort(as.host, as.port))
+}
+
+// splitQuoted splits s by sep, ignoring the sep inside quoted string
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return unescapeQuotes(s[1 : len(s)-1])
+	}
+	return s
+}
+
+// parseAltSvc parses the value of Alt-Svc header according to RFC 7838.
+// Invalid alternatives are skipped. If the value is "clear", cleared is true.
+func parseAltSvc(value string) (alts []*altSvc, cleared bool) {
+	value = strings.TrimSpace(value)
+	if value == "clear" {
+		return nil, true
+	}
+
+	for _, alt := range splitQuoted(value, ',') {
+		params := splitQuoted(alt, ';')
+		kv := strings.SplitN(strings.TrimSpace(params[0]), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		protocol, err := url.PathUnescape(kv[0])
+		if err != nil {
+			continue
+		}
+		host, port, err := net.SplitHostPort(unquote(kv[1]))
+		if err != nil {
+			continue
+		}
+		as := &altSvc{
+			protocol: protocol,
+			host:     host,
+			port:     port,
+			maxAge:   defaultAltSvcMaxAge,
+		}
+
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "ma":
+				if ma, err := strconv.Atoi(unquote(kv[1])); err == nil && ma >= 0 {
+					as.maxAge = time.Duration(ma) * time.Second
+				}
+			case "v":
+				as.versions = unquote(kv[1])
+			}
+		}
+		alts = append(alts, as)
+	}
+	return alts, false
+}
+
+// quicVersion returns the QUIC version to talk with the alternative service,
+// zero means any version. It returns false if the alternative can't be used
+// by us or conflicts with the given options.
+func (as *altSvc) quicVersion() (vn VersionNumber, http3 bool, ok bool) {
+	pinned := config.quicVersion
+	switch {
+	case as.protocol == "h3":
+		if pinned != 0 && pinned.isGQUIC() {
+			return 0, false, false
+		}
+		return pinned, true, true
+
+	case as.protocol == "quic" || strings.HasPrefix(as.protocol, "h3-Q"):
+		if config.http3 && (pinned == 0 || !pinned.isGQUIC()) {
+			return 0, false, false
+		}
+		var candidates []VersionNumber
+		if as.protocol == "quic" {
+			for _, v := range strings.Split(as.versions, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					if vn, err := parseVersion("gQUIC " + v); err == nil {
+						candidates = append(candidates, vn)
+					}
+				}
+			}
+			if as.versions == "" {
+				return pinned, false, true
+			}
+		} else if vn, err := parseVersion(as.protocol[len("h3-"):]); err == nil {
+			candidates = append(candidates, vn)
+		}
+
+		for _, vn := range candidates {
+			if pinned == 0 || vn == pinned {
+				return vn, false, true
+			}
+		}
+	}
+
+	// h3-29 and the other drafts are not supported
+	return 0, false, false
+}
+
+// originAuthority returns the host:port of the origin
+func originAuthority() string {
+	if _, _, err := net.SplitHostPort(config.originHost); err == nil {
+		return config.originHost
+	}
+	return net.JoinHostPort(config.originHost, "443")
+}
+
+// useAltSvc changes the target address and the protocol to the given
+// alternative service. The SNI and Host header are still the origin's.
+func useAltSvc(as *altSvc, vn VersionNumber, http3 bool) (string, error) {
+	uri, err := url.Parse(config.address)
+	if err != nil {
+		return "", err
+	}
+
+	host := as.host
+	if host == "" {
+		origin, _, _ := net.SplitHostPort(originAuthority())
+		host = origin
+	}
+	authority := net.JoinHostPort(host, as.port)
+	target, found := lookupResolve(authority, config)
+	if found {
+		target = firstResolvedAddr(target, config)
+	} else {
+		if as.host == "" {
+			// same host with the origin, which may be already resolved
+			target = net.JoinHostPort(uri.Hostname(), as.port)
+		} else {
+			target = authority
+		}
+	}
+
+	uri.Host = target
+	config.address = uri.String()
+	config.http3 = http3
+	config.quicVersion = vn
+	return target, nil
+}
+
+// chooseAltSvc returns the first usable alternative service
+func chooseAltSvc(alts []*altSvc) (*altSvc, VersionNumber, bool, bool) {
+	for _, as := range alts {
+		if vn, http3, ok := as.quicVersion(); ok {
+			return as, vn, http3, true
+		}
+	}
+	return nil, 0, false, false
+}
+
+func switchToAltSvc(as *altSvc, vn VersionNumber, http3 bool, how string) error {
+	target, err := useAltSvc(as, vn, http3)
+	if err != nil {
+		return err
+	}
+	proto := "gQUIC"
+	if http3 {
+		proto = "HTTP/3"
+	}
+	fmt.Fprintf(os.Stderr, "Alt-Svc: %s %s by %s, switch to %s at %s\n",
+		as, how, originAuthority(), proto, target)
+	return nil
+}
+
+// discoverAltSvc finds the alternative service of the origin, via the cache
+// or a request over TCP. If no alternative is available, the response over TCP
+// is written to the out and served is true.
+func discoverAltSvc(cm CookieManager, out io.Writer, wo *writeOutInfo) (served bool, err error) {
+	var cache altSvcCache
+	if config.altSvcCache != "" {
+		cache, err = loadAltSvcCache(config.altSvcCache)
+		if err != nil {
+			return false, err
+		}
+		if as := cache.get(originAuthority()); as != nil {
+			if vn, http3, ok := as.quicVersion(); ok {
+				return false, switchToAltSvc(as, vn, http3, "cached")
+			}
+		}
+	}
+
+	hclient := createTCPClient(cm)
+	defer destroyClient(hclient)
+
+	req, cancel, err := createReq(nil)
+	if err != nil {
+		return false, err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	resp, err := hclient.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	var alts []*altSvc
+	cleared := false
+	for _, value := range resp.Header["Alt-Svc"] {
+		as, clear := parseAltSvc(value)
+		alts = append(alts, as...)
+		cleared = cleared || clear
+	}
+
+	as, vn, http3, found := chooseAltSvc(alts)
+	if cache != nil {
+		if found {
+			cache.set(originAuthority(), as)
+		} else if cleared {
+			cache.del(originAuthority())
+		}
+		err = cache.save(config.altSvcCache)
+		if err != nil {
+			warn("failed to save Alt-Svc cache: %s", err.Error())
+		}
+	}
+
+	if !found {
+		fmt.Fprintf(os.Stderr,
+			"Alt-Svc: no QUIC alternative advertised by %s, served over %s\n",
+			originAuthority(), resp.Proto)
+		return true, handleResp(cm, req, resp, out, wo)
+	}
+
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return false, switchToAltSvc(as, vn, http3, "advertised")
+}
+
+type altSvcCacheEntry struct {
+	altSvc
+	expires time.Time
+}
+
+// altSvcCache maps the origin to its alternative service
+type altSvcCache map[string]*altSvcCacheEntry
+
+/*
+Each line of the cache file is an entry, with the fields separated by tab:
+
+origin - The host:port of the origin.
+protocol - The protocol ID of the alternative service, like h3.
+authority - The host:port of the alternative service. The host may be empty.
+expiration - The UNIX time that the entry will expire on.
+versions - Optional, the "v" parameter used by gQUIC.
+*/
+func loadAltSvcCache(fn string) (altSvcCache, error) {
+	cache := altSvcCache{}
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s := scanner.Text()
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(s, "\t")
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("invalid Alt-Svc cache entry(%s): not enough fields", s)
+		}
+		host, port, err := net.SplitHostPort(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Alt-Svc cache entry(%s): %s", s, err.Error())
+		}
+		expiration, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Alt-Svc cache entry(%s): %s", s, err.Error())
+		}
+		entry := &altSvcCacheEntry{
+			altSvc: altSvc{
+				protocol: fields[1],
+				host:     host,
+				port:     port,
+			},
+			expires: time.Unix(expiration, 0),
+		}
+		if len(fields) > 4 {
+			entry.versions = fields[4]
+		}
+		cache[fields[0]] = entry
+	}
+	return cache, scanner.Err()
+}
+
+func (c altSvcCache) get(origin string) *altSvc {
+	entry, found := c[origin]
+	if !found || time.Now().After(entry.expires) {
+		return nil
+	}
+	return &entry.altSvc
+}
+
+func (c altSvcCache) set(origin string, as *altSvc) {
+	c[origin] = &altSvcCacheEntry{
+		altSvc:  *as,
+		expires: time.Now().Add(as.maxAge),
+	}
+}
+
+func (c altSvcCache) del(origin string) {
+	delete(c, origin)
+}
+
+func (c altSvcCache) save(fn string) error {
+	f, err := openFileToWrite(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	origins := make([]string, 0, len(c))
+	for origin := range c {
+		origins = append(origins, origin)
+	}
+	// make the output reproducible
+	sort.Strings(origins)
+
+	now := time.Now()
+	for _, origin := range origins {
+		entry := c[origin]
+		if now.After(entry.expires) {
+			continue
+		}
+		line := strings.Join([]string{
+			origin,
+			entry.protocol,
+			net.JoinHostPort(entry.host, entry.port),
+			strconv.FormatInt(entry.expires.Unix(), 10),
+		}, "\t")
+		if entry.versions != "" {
+			line += "\t" + entry.versions
+		}
+		_, err = io.WriteString(f, line+"\n")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
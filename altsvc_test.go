@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAltSvc(t *testing.T) {
+	alts, cleared := parseAltSvc(`h3=":443"; ma=3600, h3-29=":443", ` +
+		`quic="alt.test.com:8443"; ma=60; v="46,43"`)
+	assert.False(t, cleared)
+	assert.Equal(t, 3, len(alts))
+	assert.Equal(t, &altSvc{protocol: "h3", port: "443", maxAge: time.Hour}, alts[0])
+	assert.Equal(t, &altSvc{protocol: "h3-29", port: "443",
+		maxAge: defaultAltSvcMaxAge}, alts[1])
+	assert.Equal(t, &altSvc{protocol: "quic", host: "alt.test.com", port: "8443",
+		maxAge: time.Minute, versions: "46,43"}, alts[2])
+	assert.Equal(t, `quic="alt.test.com:8443"`, alts[2].String())
+
+	alts, _ = parseAltSvc(`h3="[::1]:443", invalid, h2=":443"`)
+	assert.Equal(t, 2, len(alts))
+	assert.Equal(t, "::1", alts[0].host)
+
+	alts, cleared = parseAltSvc("clear")
+	assert.True(t, cleared)
+	assert.Nil(t, alts)
+}
+
+func TestChooseAltSvc(t *testing.T) {
+	defer resetArgs()
+
+	alts, _ := parseAltSvc(`h3-29=":443", quic=":443"; v="46,43", h3=":443"`)
+	as, vn, http3, found := chooseAltSvc(alts)
+	assert.True(t, found)
+	assert.Equal(t, "quic", as.protocol)
+	assert.Equal(t, Version43, vn)
+	assert.False(t, http3)
+
+	config.http3 = true
+	as, vn, http3, found = chooseAltSvc(alts)
+	assert.True(t, found)
+	assert.Equal(t, "h3", as.protocol)
+	assert.Equal(t, VersionNumber(0), vn)
+	assert.True(t, http3)
+
+	alts, _ = parseAltSvc(`h3-29=":443", h3-Q050=":443"`)
+	_, _, _, found = chooseAltSvc(alts)
+	assert.False(t, found)
+}
+
+func TestAltSvcCache(t *testing.T) {
+	_, fn := createTmpFile("# comment\n" +
+		"test.com:443\th3\t:8443\t4102444800\n" +
+		"expired.com:443\th3\t:443\t1\n")
+	cache, err := loadAltSvcCache(fn)
+	assert.Nil(t, err)
+	assert.Equal(t, &altSvc{protocol: "h3", port: "8443"}, cache.get("test.com:443"))
+	assert.Nil(t, cache.get("expired.com:443"))
+
+	cache.set("alt.com:443", &altSvc{protocol: "quic", host: "alt.com", port: "443",
+		maxAge: time.Hour, versions: "43"})
+	assert.Nil(t, cache.save(fn))
+	cache, err = loadAltSvcCache(fn)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(cache))
+	assert.Equal(t, &altSvc{protocol: "quic", host: "alt.com", port: "443",
+		versions: "43"}, cache.get("alt.com:443"))
+
+	_, fn = createTmpFile("test.com:443\th3\t:8443\n")
+	_, err = loadAltSvcCache(fn)
+	assert.NotNil(t, err)
+}
@@ -3,6 +3,9 @@ package main
 // this file contains tests which are relative with arguments check
 
 import (
+	"crypto/tls"
+	"encoding/pem"
+	"net"
 	"net/http"
 	"os"
 	"reflect"
@@ -13,7 +16,14 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// the arguments passed to the test binary
+var testArgs = os.Args
+
 func resetArgs() {
+	// TestClientSuite parses os.Args again, don't let it see the arguments
+	// used in the tests
+	os.Args = testArgs
+
 	newCfg := newQuickConfig()
 
 	aStruct := reflect.ValueOf(config).Elem()
@@ -245,3 +255,366 @@ func TestCheckArgsWhenBenchmarkModeEnaled(t *testing.T) {
 	assertCheckArgs(t, append([]string{"-dump-cookie", "x.txt"}, bmEnabledArgs...),
 		"unsupport option in benchmark mode")
 }
+
+func TestCheckQUICVersion(t *testing.T) {
+	assertCheckArgs(t, []string{"-quic-version", "gQUIC 43", "-http3", "test.com"},
+		"invalid argument: gQUIC 43 can't be used with -http3")
+	assertCheckArgs(t, []string{"-quic-version", "h3-29", "test.com"},
+		"invalid argument: QUIC draft-29 is not supported, supported versions: "+
+			"QUIC v1, QUIC v2, gQUIC 44, gQUIC 43, gQUIC 39")
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-quic-version", "v1", "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.Equal(t, Version1, config.quicVersion)
+	assert.True(t, config.http3)
+}
+
+func TestCheckProbe(t *testing.T) {
+	defer resetArgs()
+
+	os.Args = []string{"cmd", "-sni", "hi", "probe", "-json", "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.True(t, config.probe)
+	assert.True(t, config.probeJSON)
+	assert.Equal(t, "hi", config.sni)
+	assert.Equal(t, "https://test.com:443", config.address)
+
+	assertCheckArgs(t, []string{"probe"}, "no URL specified")
+	assertCheckArgs(t, []string{"-bm-duration", "1s", "-bm-req-per-conn", "3",
+		"-bm-conn", "12", "probe", "test.com"},
+		"invalid argument: probe can't be used in benchmark mode")
+}
+
+func TestCheckAltSvc(t *testing.T) {
+	assertCheckArgs(t, []string{"-alt-svc-cache", "x.txt", "test.com"},
+		"invalid argument: -alt-svc-cache requires -alt-svc")
+	assertCheckArgs(t, []string{"-alt-svc", "probe", "test.com"},
+		"invalid argument: -alt-svc can't be used with probe")
+	assertCheckArgs(t, []string{"-alt-svc", "-bm-duration", "1s", "-bm-req-per-conn", "3",
+		"-bm-conn", "12", "test.com"},
+		"invalid argument: -alt-svc can't be used in benchmark mode")
+}
+
+func TestCheckFallbackTCP(t *testing.T) {
+	assertCheckArgs(t, []string{"-fallback-tcp", "probe", "test.com"},
+		"invalid argument: -fallback-tcp can't be used with probe")
+}
+
+func TestCheck0RTT(t *testing.T) {
+	assertCheckArgs(t, []string{"-0rtt", "test.com"},
+		"invalid argument: -0rtt requires -session-file")
+	assertCheckArgs(t, []string{"-0rtt", "-quic-version", "gQUIC 43", "-session-file", "x.txt", "test.com"},
+		"invalid argument: gQUIC 43 can't be used with -0rtt")
+	assertCheckArgs(t, []string{"-0rtt", "-session-file", "x.txt", "-d", "a", "test.com"},
+		"invalid argument: -0rtt can't be used with method POST, only GET and HEAD are allowed")
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-0rtt", "-session-file", "x.txt", "-I", "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.True(t, config.http3)
+}
+
+func TestCheckQlogDir(t *testing.T) {
+	assertCheckArgs(t, []string{"-qlog-dir", "qlog", "-quic-version", "gQUIC 43", "test.com"},
+		"invalid argument: gQUIC 43 can't be used with -qlog-dir")
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-qlog-dir", "qlog", "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.True(t, config.http3)
+}
+
+func TestCheckClientCert(t *testing.T) {
+	assertCheckArgs(t, []string{"-key", "key.pem", "test.com"},
+		"invalid argument: -key requires -cert")
+	assertCheckArgs(t, []string{"-cert", "cert.pem", "-quic-version", "gQUIC 43", "test.com"},
+		"invalid argument: gQUIC 43 can't be used with -cert")
+	assertCheckArgs(t, []string{"-cert", "not-exist.pem", "test.com"},
+		"invalid argument: -cert: open not-exist.pem: no such file or directory")
+}
+
+func TestCheckCACert(t *testing.T) {
+	assertCheckArgs(t, []string{"-cacert", "not-exist.pem", "test.com"},
+		"invalid argument: -cacert/-capath: open not-exist.pem: no such file or directory")
+	assertCheckArgs(t, []string{"-pinnedpubkey", "sha256//AAAA", "test.com"},
+		"invalid argument: -pinnedpubkey: sha256//AAAA: wrong length of the sha256 hash")
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	certDER, _ := generateClientCert("ca")
+	writeFile(dir, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+
+	defer resetArgs()
+	// the server is verified in benchmark mode if the CA is given
+	os.Args = []string{"cmd", "-capath", dir,
+		"-bm-duration", "1s", "-bm-req-per-conn", "3", "-bm-conn", "12", "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.True(t, config.bmEnabled)
+	assert.False(t, config.insecure)
+	assert.NotNil(t, config.rootCAs)
+}
+
+func TestCheckShowCert(t *testing.T) {
+	assertCheckArgs(t, []string{"-show-cert", "probe", "test.com"},
+		"invalid argument: -show-cert and -export-cert can't be used with probe")
+	assertCheckArgs(t, []string{"-export-cert", "x.pem", "-bm-duration", "1s",
+		"-bm-req-per-conn", "3", "-bm-conn", "12", "test.com"},
+		"invalid argument: -show-cert and -export-cert can't be used in benchmark mode")
+}
+
+func TestCheckTLSParams(t *testing.T) {
+	assertCheckArgs(t, []string{"-tls-max", "1.0", "test.com"},
+		"invalid argument: -tls-max: unknown TLS version 1.0, valid versions: 1.2, 1.3")
+	assertCheckArgs(t, []string{"-ciphers", "TLS_AES_128_GCM_SHA256", "test.com"},
+		"invalid argument: -ciphers: TLS 1.3 cipher suite TLS_AES_128_GCM_SHA256 is not configurable")
+	assertCheckArgs(t, []string{"-curves", "X25519", "-quic-version", "gQUIC 43", "test.com"},
+		"invalid argument: gQUIC 43 can't be used with -tls-max or -curves")
+	assertCheckArgs(t, []string{"-tls-max", "1.2", "test.com"},
+		"invalid argument: -tls-max 1.2 requires -fallback-tcp or -alt-svc, as QUIC requires TLS 1.3")
+	assertCheckArgs(t, []string{"-tls-max", "1.2", "-fallback-tcp", "test.com"}, "")
+	assertCheckArgs(t, []string{"-tls-max", "1.3", "test.com"}, "")
+	assertCheckArgs(t, []string{"-ciphers", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "test.com"},
+		"invalid argument: -ciphers requires -fallback-tcp or -alt-svc, as QUIC requires TLS 1.3")
+	assertCheckArgs(t, []string{"-ciphers", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"-alt-svc", "test.com"}, "")
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-curves", "X25519:P-256", "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.True(t, config.http3)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, config.curves)
+}
+
+func TestCheckQUICParams(t *testing.T) {
+	assertCheckArgs(t, []string{"-quic-stream-window", "1MB", "-quic-initial-stream-window", "2MB", "test.com"},
+		"invalid argument: -quic-initial-stream-window 2MB is larger than -quic-stream-window 1MB")
+	assertCheckArgs(t, []string{"-quic-keep-alive", "-1s", "test.com"},
+		"invalid argument: -quic-keep-alive should not be negative, got -1s")
+	assertCheckArgs(t, []string{"-quic-disable-pmtud", "-quic-version", "gQUIC 43", "test.com"},
+		"invalid argument: gQUIC 43 can't be used with -quic-initial-stream-window, "+
+			"-quic-initial-conn-window, -quic-initial-packet-size or -quic-disable-pmtud")
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-quic-conn-window", "30MB", "-quic-max-streams", "10", "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.False(t, config.http3)
+	assert.Equal(t, sizeValue(30<<20), config.quicParams.connWindow)
+	assert.Equal(t, 10, config.quicParams.maxStreams)
+
+	os.Args = []string{"cmd", "-quic-initial-packet-size", "1400", "test.com"}
+	err = checkArgs()
+	assert.Nil(t, err)
+	assert.True(t, config.http3)
+}
+
+func TestCheckIPFamily(t *testing.T) {
+	assertCheckArgs(t, []string{"-4", "-6", "test.com"},
+		"invalid argument: -4 can't be used with -6")
+	assertCheckArgs(t, []string{"-6", "test.com"}, "")
+}
+
+func TestCheckNameResolution(t *testing.T) {
+	assertCheckArgs(t, []string{"-dns-servers", "dns.test.com", "test.com"},
+		"invalid argument: -dns-servers: invalid DNS server dns.test.com")
+	assertCheckArgs(t, []string{"-hosts-file", "/not/exists", "test.com"},
+		"invalid argument: -hosts-file: open /not/exists: no such file or directory")
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-dns-servers", "127.0.0.1:5353", "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.NotNil(t, config.dnsResolver)
+}
+
+func TestCheckHTTPSRR(t *testing.T) {
+	assertCheckArgs(t, []string{"-https-rr", "-quic-version", "gQUIC 43", "test.com"},
+		"invalid argument: gQUIC 43 can't be used with -https-rr")
+	assertCheckArgs(t, []string{"-https-rr", "-alt-svc", "test.com"},
+		"invalid argument: -https-rr can't be used with -alt-svc")
+	assertCheckArgs(t, []string{"-https-rr", "probe", "test.com"},
+		"invalid argument: -https-rr can't be used with probe")
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-https-rr", "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.True(t, config.http3)
+}
+
+func TestCheckMultipleURLs(t *testing.T) {
+	assertCheckArgs(t, []string{"test.com/[1-x]"}, "invalid argument: bad range [1-x]")
+	assertCheckArgs(t, []string{"test.com", "http://test.com"}, "URL invalid")
+	assertCheckArgs(t, []string{"-o", "out.txt", "test.com/{a,b}"},
+		"invalid argument: -o should contain #N to write the responses of multiple URLs to separate files")
+	assertCheckArgs(t, []string{"-o", "out_#1", "test.com", "www.test.com"},
+		"invalid argument: -o: #1 refers to a glob not in test.com")
+	assertCheckArgs(t, []string{"-o", "out_#2", "test.com/{a,b}"},
+		"invalid argument: -o: #2 refers to a glob not in test.com/a")
+	assertCheckArgs(t, []string{"-o", "out_#1", "test.com/{a,b}", "www.test.com/{a}"},
+		"invalid argument: -o: test.com/a and www.test.com/a are written to the same file out_a")
+	assertCheckArgs(t, []string{"-alt-svc", "test.com", "www.test.com"},
+		"invalid argument: -alt-svc can't be used with multiple URLs")
+	assertCheckArgs(t, []string{"probe", "test.com", "www.test.com"},
+		"invalid argument: probe accepts only one URL")
+	assertCheckArgs(t, []string{"-bm-duration", "1s", "-bm-req-per-conn", "3", "-bm-conn", "12",
+		"test.com/[1-2]"}, "invalid argument: benchmark mode accepts only one URL")
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-o", "item_#1", "test.com/{a,b}", "www.test.com:8443/{c}"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.Equal(t, []globURL{
+		{url: "test.com/a", values: []string{"a"}},
+		{url: "test.com/b", values: []string{"b"}},
+		{url: "www.test.com:8443/c", values: []string{"c"}},
+	}, config.urls)
+	assert.Equal(t, "https://test.com:443/a", config.address)
+
+	err = useURL(config.urls[2].url)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://www.test.com:8443/c", config.address)
+	assert.Equal(t, "www.test.com", config.sni)
+}
+
+func TestCheckParallel(t *testing.T) {
+	assertCheckArgs(t, []string{"-parallel", "-parallel-max", "0", "test.com"},
+		"invalid argument: -parallel-max should be positive, got 0")
+	assertCheckArgs(t, []string{"-parallel", "-w", "%{http_code}", "test.com"},
+		"invalid argument: -parallel can't be used with -w")
+	assertCheckArgs(t, []string{"-parallel", "-alt-svc", "test.com"},
+		"invalid argument: -parallel can't be used with -alt-svc")
+	assertCheckArgs(t, []string{"-parallel", "-show-cert", "test.com"},
+		"invalid argument: -parallel can't be used with -show-cert or -export-cert")
+	assertCheckArgs(t, []string{"-parallel", "probe", "test.com"},
+		"invalid argument: -parallel can't be used with probe")
+	assertCheckArgs(t, []string{"-parallel", "-bm-duration", "1s", "-bm-req-per-conn", "3",
+		"-bm-conn", "12", "test.com"}, "invalid argument: -parallel can't be used in benchmark mode")
+	assertCheckArgs(t, []string{"-urls-file", "no-such-file", "test.com"},
+		"invalid argument: -urls-file: open no-such-file: no such file or directory")
+
+	_, fn := createTmpFile("# comment\n\ntest.com/[1-2]\n  www.test.com  \n")
+	defer os.Remove(fn)
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-parallel", "-urls-file", fn}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.Equal(t, []globURL{
+		{url: "test.com/1", values: []string{"1"}},
+		{url: "test.com/2", values: []string{"2"}},
+		{url: "www.test.com", values: []string{}},
+	}, config.urls)
+	assert.Equal(t, "https://test.com:443/1", config.address)
+	assert.Equal(t, 50, config.parallelMax)
+}
+
+func TestCheckRequestsFile(t *testing.T) {
+	_, fn := createTmpFile(`{"url": "test.com/a"}
+{"url": "www.test.com:8443/b", "method": "POST", "body": "x"}
+`)
+	defer os.Remove(fn)
+
+	assertCheckArgs(t, []string{"-requests-file", fn, "test.com"},
+		"invalid argument: URL can't be given with -requests-file")
+	assertCheckArgs(t, []string{"-requests-file", "no-such-file"},
+		"invalid argument: -requests-file: open no-such-file: no such file or directory")
+	assertCheckArgs(t, []string{"-requests-file", fn, "-bm-duration", "1s", "-bm-req-per-conn", "3",
+		"-bm-conn", "12"}, "invalid argument: -requests-file can't be used in benchmark mode")
+	assertCheckArgs(t, []string{"-requests-file", fn, "-o", "out.txt"},
+		"invalid argument: output customization is not allowed with -requests-file")
+	assertCheckArgs(t, []string{"-requests-file", fn, "-d", "x"},
+		"invalid argument: -requests-file can't be used with -d or -F")
+	assertCheckArgs(t, []string{"-requests-file", fn, "-parallel"},
+		"invalid argument: -requests-file can't be used with -parallel")
+	assertCheckArgs(t, []string{"-requests-file", fn, "-alt-svc"},
+		"invalid argument: -alt-svc can't be used with multiple URLs")
+	assertCheckArgs(t, []string{"-results-file", "results.jsonl", "test.com"},
+		"invalid argument: -results-file requires -requests-file")
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-requests-file", fn}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(config.requests))
+	assert.Equal(t, []globURL{{url: "test.com/a"}, {url: "www.test.com:8443/b"}}, config.urls)
+	assert.Equal(t, "https://test.com:443/a", config.address)
+}
+
+func TestCheckRetry(t *testing.T) {
+	assertCheckArgs(t, []string{"-retry", "-1", "test.com"},
+		"invalid argument: -retry should not be negative, got -1")
+	assertCheckArgs(t, []string{"-retry-delay", "-1s", "test.com"},
+		"invalid argument: -retry-delay should not be negative, got -1s")
+	assertCheckArgs(t, []string{"-retry-max-time", "-1s", "test.com"},
+		"invalid argument: -retry-max-time should not be negative, got -1s")
+	assertCheckArgs(t, []string{"-retry", "3", "probe", "test.com"},
+		"invalid argument: -retry can't be used with probe")
+	assertCheckArgs(t, []string{"-retry", "3", "-parallel", "test.com"},
+		"invalid argument: -retry can't be used with -parallel")
+	assertCheckArgs(t, []string{"-retry", "3", "-bm-duration", "1s", "-bm-req-per-conn", "3",
+		"-bm-conn", "12", "test.com"}, "invalid argument: -retry can't be used in benchmark mode")
+	assertCheckArgs(t, []string{"-retry", "3", "-retry-delay", "1s", "-retry-max-time", "10s",
+		"-retry-all-errors", "test.com"}, "")
+}
+
+func TestCheckLocalAddr(t *testing.T) {
+	assertCheckArgs(t, []string{"-interface", "no-such-iface", "test.com"},
+		"invalid argument: -interface: no-such-iface is neither an IP address nor an interface")
+	assertCheckArgs(t, []string{"-local-port", "9100-9000", "test.com"},
+		"invalid argument: -local-port: invalid port range 9100-9000")
+	assertCheckArgs(t, []string{"-local-port", "x", "test.com"},
+		"invalid argument: -local-port: invalid port x")
+	assertCheckArgs(t, []string{"-local-port", "9000", "-quic-version", "gQUIC 44", "test.com"},
+		"invalid argument: gQUIC 44 can't be used with -interface or -local-port")
+	assertCheckArgs(t, []string{"-interface", "127.0.0.1", "probe", "test.com"},
+		"invalid argument: -interface and -local-port can't be used with probe")
+
+	defer resetArgs()
+	os.Args = []string{"cmd", "-interface", "127.0.0.1,::1", "-local-port", "9000-9100", "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]net.IP{{net.ParseIP("127.0.0.1")}, {net.ParseIP("::1")}}, config.localIPs)
+	assert.Equal(t, 9000, config.localPortMin)
+	assert.Equal(t, 9100, config.localPortMax)
+}
+
+func TestCheckBenchmarkNewConn(t *testing.T) {
+	bmEnabledArgs := []string{"-bm-duration", "1s", "-bm-req-per-conn", "3", "-bm-conn", "12", "test.com"}
+	assertCheckArgs(t, append([]string{"-bm-new-conn", "-1"}, bmEnabledArgs...),
+		"invalid argument: -bm-new-conn should not be negative, got -1")
+	assertCheckArgs(t, append([]string{"-0rtt", "-session-file", "x.txt"}, bmEnabledArgs...),
+		"invalid argument: -0rtt requires -bm-new-conn in benchmark mode")
+	assertCheckArgs(t, append([]string{"-0rtt", "-session-file", "x.txt", "-bm-new-conn", "1"},
+		bmEnabledArgs...), "")
+}
+
+func TestCheckWriteOut(t *testing.T) {
+	assertCheckArgs(t, []string{"-w", "%{xxx}", "test.com"},
+		"invalid argument: -w: unknown variable %{xxx}")
+	assertCheckArgs(t, []string{"-w", "%{http_code}", "probe", "test.com"},
+		"invalid argument: -w can't be used with probe")
+
+	defer resetArgs()
+	_, fn := createTmpFile("%{http_code}\n")
+	defer os.Remove(fn)
+	os.Args = []string{"cmd", "-w", "@" + fn, "test.com"}
+	err := checkArgs()
+	assert.Nil(t, err)
+	assert.Equal(t, "%{http_code}\n", config.writeOut)
+}
+
+func TestCheckVerbose(t *testing.T) {
+	assertCheckArgs(t, []string{"-v", "probe", "test.com"},
+		"invalid argument: -v can't be used with probe")
+	assertCheckArgs(t, []string{"-v", "-bm-duration", "1s", "-bm-req-per-conn", "3",
+		"-bm-conn", "12", "test.com"},
+		"invalid argument: -v can't be used in benchmark mode")
+}
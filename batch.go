@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// batchRequest is a line of the -requests-file
+type batchRequest struct {
+	Name    string            `json:"name"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// the body is inline, or read from a file if it starts with '@', like -d
+	Body       string `json:"body"`
+	BodyBase64 string `json:"body_base64"`
+	// the request fails if the status is not the expected one
+	ExpectStatus int `json:"expect_status"`
+
+	line int
+	body func() (io.ReadCloser, string, error)
+}
+
+// batchTiming is the times used by the request in seconds, like the time_*
+// variables of -w
+type batchTiming struct {
+	NameLookup    float64 `json:"namelookup"`
+	Connect       float64 `json:"connect"`
+	StartTransfer float64 `json:"starttransfer"`
+	Total         float64 `json:"total"`
+}
+
+// batchResult is a line of the results
+type batchResult struct {
+	Line       int         `json:"line"`
+	Name       string      `json:"name,omitempty"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Status     int         `json:"status,omitempty"`
+	Proto      string      `json:"proto,omitempty"`
+	Headers    http.Header `json:"headers,omitempty"`
+	BodySize   int64       `json:"body_size"`
+	BodySHA256 string      `json:"body_sha256,omitempty"`
+	Timing     batchTiming `json:"timing"`
+	Error      string      `json:"error,omitempty"`
+}
+
+func parseBatchRequest(data []byte) (*batchRequest, error) {
+	br := &batchRequest{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// catch the typo in the field names
+	dec.DisallowUnknownFields()
+	err := dec.Decode(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if br.URL == "" {
+		return nil, errors.New("url is required")
+	}
+	_, err = parseURL(br.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if br.Body != "" && br.BodyBase64 != "" {
+		return nil, errors.New("body can't be used with body_base64")
+	}
+	if br.Body != "" {
+		var dv dataValue
+		err = dv.Set(br.Body)
+		if err != nil {
+			return nil, err
+		}
+		br.body = func() (io.ReadCloser, string, error) {
+			return dv.Open(config.contentType)
+		}
+	} else if br.BodyBase64 != "" {
+		body, err := base64.StdEncoding.DecodeString(br.BodyBase64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body_base64: %s", err.Error())
+		}
+		br.body = func() (io.ReadCloser, string, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), config.contentType, nil
+		}
+	}
+
+	if br.Method == "" {
+		br.Method = http.MethodGet
+		if br.body != nil {
+			br.Method = http.MethodPost
+		}
+	} else {
+		br.Method, err = checkMethod(br.Method)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return br, nil
+}
+
+// loadBatchRequests reads the requests from the file in JSON Lines format.
+// The blank lines and the lines starting with '#' are skipped.
+func loadBatchRequests(fn string) ([]*batchRequest, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requests []*batchRequest
+	scanner := bufio.NewScanner(f)
+	// allow large inline bodies
+	scanner.Buffer(nil, 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		br, err := parseBatchRequest(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err.Error())
+		}
+		br.line = lineNo
+		requests = append(requests, br)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, errors.New("no request found")
+	}
+	return requests, nil
+}
+
+// spec returns the request to the config.address. The headers given via -H
+// are sent too, unless they are overridden.
+func (br *batchRequest) spec() *reqSpec {
+	header := http.Header{}
+	for k, v := range config.customHeaders.hdr {
+		header[k] = v
+	}
+	for k, v := range br.Headers {
+		header.Set(k, v)
+	}
+	return &reqSpec{
+		method:     br.Method,
+		address:    config.address,
+		originHost: config.originHost,
+		header:     header,
+		openBody:   br.body,
+	}
+}
+
+// collect fills the timing and the body size collected by the wo
+func (res *batchResult) collect(wo *writeOutInfo) {
+	wo.handshakes.Wait()
+	wo.lock.Lock()
+	defer wo.lock.Unlock()
+
+	wo.timeTotal = time.Since(wo.start)
+	res.Timing = batchTiming{
+		NameLookup:    wo.timeNameLookup.Seconds(),
+		Connect:       wo.timeConnect.Seconds(),
+		StartTransfer: wo.timeStartTransfer.Seconds(),
+		Total:         wo.timeTotal.Seconds(),
+	}
+	res.BodySize = wo.sizeDownload
+}
+
+// doBatchRequest sends the request and fills the result
+func doBatchRequest(nc *normalClient, br *batchRequest, res *batchResult) error {
+	req, cancel, err := createReqFrom(br.spec(), nil)
+	if err != nil {
+		return err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	resp, err := nc.Do(req)
+	if err != nil {
+		reportClientCert(err)
+		return explainHandshakeError(err)
+	}
+	nc.wo.gotResp(resp)
+	res.Status = resp.StatusCode
+	res.Proto = resp.Proto
+	res.Headers = resp.Header
+
+	h := sha256.New()
+	err = readRespTo(req, resp, h, respOutput{}, make([]byte, 32*1024))
+	if err != nil {
+		return err
+	}
+	res.BodySHA256 = hex.EncodeToString(h.Sum(nil))
+	if br.ExpectStatus != 0 && br.ExpectStatus != resp.StatusCode {
+		return fmt.Errorf("expected status %d, got %d", br.ExpectStatus, resp.StatusCode)
+	}
+	return nil
+}
+
+// runInBatchMode sends the requests in the -requests-file one by one, and
+// writes the results in JSON Lines format. The client is shared by the
+// requests with the same SNI, so that the connection is reused.
+func runInBatchMode(cm CookieManager, out io.Writer) error {
+	if config.resultsFile != "" {
+		f, err := openFileToWrite(config.resultsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	wo := newWriteOutInfo()
+	clients := map[string]*normalClient{}
+	defer func() {
+		for _, nc := range clients {
+			destroyClient(nc.Client)
+		}
+	}()
+
+	enc := json.NewEncoder(out)
+	failed := 0
+	for i, br := range config.requests {
+		res := &batchResult{
+			Line:   br.line,
+			Name:   br.Name,
+			Method: br.Method,
+			URL:    br.URL,
+		}
+		wo.reset()
+		nc, err := useNthURL(cm, i, clients, wo)
+		if err == nil {
+			err = doBatchRequest(nc, br, res)
+		}
+		res.collect(wo)
+		if err != nil {
+			failed++
+			res.Error = err.Error()
+		}
+		err = enc.Encode(res)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.dumpCookie != "" {
+		err := cm.Dump(config.dumpCookie)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to dump cookie: "+err.Error())
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Requests: %d passed, %d failed\n",
+		len(config.requests)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d requests failed", failed, len(config.requests))
+	}
+	return nil
+}
+
+// batchURLs returns the URLs of the requests, which are not expanded as globs
+func batchURLs(requests []*batchRequest) []globURL {
+	urls := make([]globURL, len(requests))
+	for i, br := range requests {
+		urls[i] = globURL{url: br.URL}
+	}
+	return urls
+}
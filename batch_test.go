@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadBatchRequests(t *testing.T) {
+	_, fn := createTmpFile(`# smoke tests
+{"url": "test.com/a"}
+
+{"name": "create", "url": "test.com/b", "body": "{\"a\":1}", "expect_status": 201}
+{"method": "put", "url": "test.com/c", "headers": {"x-key": "v"}, "body_base64": "AAE="}
+{"method": "head", "url": "test.com/d", "body": "@testdata/a.html"}
+`)
+	defer os.Remove(fn)
+
+	requests, err := loadBatchRequests(fn)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 4, len(requests))
+	assert.Equal(t, 2, requests[0].line)
+	assert.Equal(t, "GET", requests[0].Method)
+	assert.Nil(t, requests[0].body)
+
+	assert.Equal(t, "POST", requests[1].Method)
+	assert.Equal(t, 201, requests[1].ExpectStatus)
+	body, ct, err := requests[1].body()
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(body)
+	assert.Equal(t, `{"a":1}`, string(data))
+	assert.Equal(t, defaultContentType, ct)
+
+	assert.Equal(t, "PUT", requests[2].Method)
+	body, _, _ = requests[2].body()
+	data, _ = ioutil.ReadAll(body)
+	assert.Equal(t, []byte{0, 1}, data)
+	// the Content-Type given via -H is used like -d
+	config.contentType = "text/plain"
+	defer resetArgs()
+	_, ct, _ = requests[2].body()
+	assert.Equal(t, "text/plain", ct)
+
+	assert.Equal(t, "HEAD", requests[3].Method)
+	body, ct, err = requests[3].body()
+	assert.Nil(t, err)
+	body.Close()
+	assert.Equal(t, "text/html; charset=utf-8", ct)
+}
+
+func TestLoadBatchRequestsFailed(t *testing.T) {
+	for line, msg := range map[string]string{
+		`{"url": "test.com", "expect": 200}`:                      `line 1: json: unknown field "expect"`,
+		`{"method": "GET"}`:                                       "line 1: url is required",
+		`{"url": "http://test.com"}`:                              "line 1: URL invalid",
+		`{"url": "test.com", "method": "trace"}`:                  "line 1: method TRACE is unsupported",
+		`{"url": "test.com", "body": "a", "body_base64": "YQ=="}`: "line 1: body can't be used with body_base64",
+		`{"url": "test.com", "body_base64": "!"}`:                 "line 1: invalid body_base64: illegal base64 data at input byte 0",
+		"# nothing": "no request found",
+	} {
+		_, fn := createTmpFile(line)
+		_, err := loadBatchRequests(fn)
+		os.Remove(fn)
+		if assert.NotNil(t, err, line) {
+			assert.Equal(t, msg, err.Error())
+		}
+	}
+}
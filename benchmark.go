@@ -2,13 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/h2quic"
+	iquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/zoidbergwill/hdrhistogram"
 )
 
@@ -17,12 +24,24 @@ type bmStat struct {
 	reqs          int64
 	badStatusCode int64
 	latency       *hdrhistogram.Histogram
+	// the number of connections per protocol, only used with -fallback-tcp
+	protocols map[string]int
+
+	// only used with -bm-new-conn
+	handshakes     int64
+	handshake      *hdrhistogram.Histogram
+	handshakeModes map[string]int
 }
 
 func newBmStat() *bmStat {
-	return &bmStat{
+	bs := &bmStat{
 		latency: hdrhistogram.New(0, int64(config.bmDuration), 5),
 	}
+	if config.bmNewConn > 0 {
+		bs.handshake = hdrhistogram.New(0, int64(config.bmDuration), 5)
+		bs.handshakeModes = map[string]int{}
+	}
+	return bs
 }
 
 func (bs *bmStat) AddErr(err error) {
@@ -43,6 +62,23 @@ func (bs *bmStat) Merge(other *bmStat) {
 	bs.badStatusCode += other.badStatusCode
 	bs.latency.Merge(other.latency)
 
+	if other.handshake != nil {
+		bs.handshakes += other.handshakes
+		bs.handshake.Merge(other.handshake)
+		for mode, n := range other.handshakeModes {
+			bs.handshakeModes[mode] += n
+		}
+	}
+
+	if other.protocols != nil {
+		if bs.protocols == nil {
+			bs.protocols = map[string]int{}
+		}
+		for proto, n := range other.protocols {
+			bs.protocols[proto] += n
+		}
+	}
+
 	if other.errs == nil {
 		return
 	}
@@ -70,12 +106,51 @@ func (bs *bmStat) PrintErr(out io.Writer) {
 	}
 }
 
+func (bs *bmStat) PrintProtocols(out io.Writer) {
+	if bs.protocols == nil {
+		return
+	}
+	protocols := make([]string, 0, len(bs.protocols))
+	for proto := range bs.protocols {
+		protocols = append(protocols, proto)
+	}
+	// make the output reproducible
+	sort.Strings(protocols)
+	fmt.Fprintf(out, "  Protocols:\n")
+	for _, proto := range protocols {
+		fmt.Fprintf(out, "\t%s\t%d connections\n", proto, bs.protocols[proto])
+	}
+}
+
 func formatLatencyDuration(v float64) string {
 	return time.Duration(v).Round(10 * time.Microsecond).String()
 }
 
 func (bs *bmStat) PrintLatency(out io.Writer) {
-	lat := bs.latency
+	printHistogram(out, "Latency", bs.latency, bs.reqs)
+}
+
+func (bs *bmStat) PrintHandshake(out io.Writer) {
+	if bs.handshake == nil {
+		return
+	}
+	fmt.Fprintf(out, "  %d new connections\n", bs.handshakes)
+	printHistogram(out, "Handshake", bs.handshake, bs.handshakes)
+
+	modes := []string{}
+	for _, mode := range []string{handshakeFull, handshakeResumed, handshake0RTT} {
+		if n := bs.handshakeModes[mode]; n > 0 {
+			modes = append(modes, fmt.Sprintf("%s %d", mode, n))
+		}
+	}
+	if len(modes) > 0 {
+		fmt.Fprintf(out, "  Handshake modes: %s\n", strings.Join(modes, ", "))
+	}
+}
+
+func printHistogram(out io.Writer, item string, lat *hdrhistogram.Histogram,
+	total int64) {
+
 	avg := lat.Mean()
 	stdev := lat.StdDev()
 	max := lat.Max()
@@ -93,13 +168,13 @@ func (bs *bmStat) PrintLatency(out io.Writer) {
 		}
 	}
 	inStdevRate := 0.0
-	if bs.reqs != 0 {
-		inStdevRate = float64(count*10000/bs.reqs) / 100
+	if total != 0 {
+		inStdevRate = float64(count*10000/total) / 100
 	}
 
 	table := [][]string{
 		{"Item", "Avg", "Stdev", "Max", "+/-Stdev"},
-		{"Latency",
+		{item,
 			formatLatencyDuration(avg),
 			formatLatencyDuration(stdev),
 			formatLatencyDuration(float64(max)),
@@ -111,7 +186,7 @@ func (bs *bmStat) PrintLatency(out io.Writer) {
 		fmt.Fprintf(out, "  %10s %8s %10s %9s %10s\n",
 			row[0], row[1], row[2], row[3], row[4])
 	}
-	fmt.Fprintln(out, "  Latency Distribution")
+	fmt.Fprintf(out, "  %s Distribution\n", item)
 	percents := []float64{50, 75, 90, 95, 99, 99.5, 99.9}
 	for _, p := range percents {
 		fmt.Fprintf(out, "    %0.1f%%\t%s\n", p,
@@ -141,7 +216,9 @@ func printStats(timeUsed time.Duration, stats []*bmStat, out io.Writer) {
 	}
 	fmt.Fprintf(out, "  %d requests in %v\n", total.reqs, timeUsed)
 	total.PrintLatency(out)
+	total.PrintHandshake(out)
 	total.PrintBadStatusCode(out)
+	total.PrintProtocols(out)
 	total.PrintErr(out)
 	fmt.Fprintf(out, "Requests/sec:    %f\n", float64(total.reqs)/timeUsed.Seconds())
 }
@@ -150,12 +227,19 @@ type reqResult struct {
 	err        error
 	statusCode int
 	time       time.Duration
+	// the handshake of the new connection used by this request, if any
+	handshake *handshakeInfo
+	// the protocol of the new connection used by this request, only used with
+	// -fallback-tcp
+	protocol string
 }
 
 func (rr *reqResult) zero() {
 	rr.err = nil
 	rr.statusCode = 0
 	rr.time = 0
+	rr.handshake = nil
+	rr.protocol = ""
 }
 
 type reqCtx struct {
@@ -190,13 +274,131 @@ func aggregateStatFromReqCtx(stat *bmStat, ctx *reqCtx) {
 	if err != nil {
 		warn(err.Error())
 	}
+	if hs := res.handshake; hs != nil {
+		stat.handshakes++
+		stat.handshakeModes[hs.mode]++
+		err = stat.handshake.RecordValue(int64(hs.time))
+		if err != nil {
+			warn(err.Error())
+		}
+	}
+	if res.protocol != "" {
+		if stat.protocols == nil {
+			stat.protocols = map[string]int{}
+		}
+		stat.protocols[res.protocol]++
+	}
 
 	ctx.res.zero()
 	reqCtxPool.Put(ctx)
 }
 
-func runReqsInParallel(hclient *http.Client, pStat **bmStat, wg *sync.WaitGroup,
-	cancelled <-chan struct{}) {
+const (
+	handshakeFull    = "full"
+	handshakeResumed = "resumed"
+	handshake0RTT    = "0-RTT"
+)
+
+// handshakeInfo describes the handshake of a new connection
+type handshakeInfo struct {
+	time time.Duration
+	// one of handshakeFull, handshakeResumed and handshake0RTT
+	mode   string
+	failed bool
+}
+
+// hookHandshake wraps the Dial of the client's transport, and sends the
+// handshake of the new connection to the returned channel. It returns nil if
+// the transport is not supported.
+func hookHandshake(hclient *http.Client) <-chan handshakeInfo {
+	ch := make(chan handshakeInfo, 1)
+	report := func(hs handshakeInfo) {
+		select {
+		case ch <- hs:
+		default:
+		}
+	}
+
+	rt := hclient.Transport
+	if frt, ok := rt.(*fallbackRoundTripper); ok {
+		// the handshake over TCP is not measured
+		rt = frt.quicRT
+	}
+
+	switch rt := rt.(type) {
+	case *h2quic.RoundTripper:
+		dial := rt.Dial
+		rt.Dial = func(network, addr string, tlsCfg *tls.Config,
+			cfg *quic.Config) (quic.Session, error) {
+
+			start := time.Now()
+			sess, err := dial(network, addr, tlsCfg, cfg)
+			// gQUIC doesn't tell us if the handshake is resumed
+			report(handshakeInfo{
+				time:   time.Since(start),
+				mode:   handshakeFull,
+				failed: err != nil,
+			})
+			return sess, err
+		}
+	case *http3.Transport:
+		dial := rt.Dial
+		rt.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config,
+			cfg *iquic.Config) (*iquic.Conn, error) {
+
+			start := time.Now()
+			conn, err := dial(ctx, addr, tlsCfg, cfg)
+			if err != nil {
+				report(handshakeInfo{failed: true})
+				return conn, err
+			}
+			// the connection may be returned before the handshake is completed
+			// when 0-RTT is used
+			go func() {
+				select {
+				case <-conn.HandshakeComplete():
+				case <-conn.Context().Done():
+					report(handshakeInfo{failed: true})
+					return
+				}
+				hs := handshakeInfo{
+					time: time.Since(start),
+					mode: handshakeFull,
+				}
+				state := conn.ConnectionState()
+				if state.Used0RTT {
+					hs.mode = handshake0RTT
+				} else if state.TLS.DidResume {
+					hs.mode = handshakeResumed
+				}
+				report(hs)
+			}()
+			return conn, err
+		}
+	default:
+		return nil
+	}
+	return ch
+}
+
+func waitHandshake(ch <-chan handshakeInfo) *handshakeInfo {
+	select {
+	case hs := <-ch:
+		if hs.failed {
+			return nil
+		}
+		return &hs
+	case <-time.After(config.connectTimeout):
+		// the connection is not dialed
+		return nil
+	}
+}
+
+// runReqsInParallel sends requests via the given client. If the client is
+// nil, each goroutine creates its own client and replaces it every
+// config.bmNewConn requests.
+func runReqsInParallel(hclient *http.Client, cm CookieManager, pStat **bmStat,
+	wg *sync.WaitGroup, cancelled <-chan struct{}) {
 
 	defer wg.Done()
 	stat := newBmStat()
@@ -209,7 +411,21 @@ func runReqsInParallel(hclient *http.Client, pStat **bmStat, wg *sync.WaitGroup,
 	reqWg.Add(config.bmReqPerConn)
 	for i := 0; i < config.bmReqPerConn; i++ {
 		go func() {
+			conn := hclient
+			var hsCh <-chan handshakeInfo
+			var frt *fallbackRoundTripper
+			reqs := 0
 			for {
+				if conn == nil {
+					var err error
+					conn, err = createClient(cm)
+					if err != nil {
+						fatal(err.Error())
+					}
+					hsCh = hookHandshake(conn)
+					frt, _ = conn.Transport.(*fallbackRoundTripper)
+				}
+
 				ctx := reqCtxPool.Get().(*reqCtx)
 				reqRes := ctx.res
 				req, cancel, err := createReq(ctx.oldReq)
@@ -217,6 +433,9 @@ func runReqsInParallel(hclient *http.Client, pStat **bmStat, wg *sync.WaitGroup,
 					// failed to prepare the request body? stop the benchmark immediately
 					fatal(err.Error())
 				}
+				if config.zeroRTT {
+					req.Method = to0RTTMethod(req.Method)
+				}
 				ctx.oldReq = req
 
 				if len(ctx.respBuf) == 0 {
@@ -224,7 +443,7 @@ func runReqsInParallel(hclient *http.Client, pStat **bmStat, wg *sync.WaitGroup,
 				}
 
 				reqStart := time.Now()
-				resp, err := hclient.Do(req)
+				resp, err := conn.Do(req)
 				if err != nil {
 					goto failed
 				}
@@ -237,12 +456,33 @@ func runReqsInParallel(hclient *http.Client, pStat **bmStat, wg *sync.WaitGroup,
 				reqRes.statusCode = resp.StatusCode
 				goto finished
 			failed:
-				reqRes.err = err
+				reqRes.err = explainHandshakeError(err)
+				reportClientCert(err)
 			finished:
 				reqRes.time = time.Since(reqStart)
+				if hsCh != nil {
+					reqRes.handshake = waitHandshake(hsCh)
+					hsCh = nil
+				}
+				if frt != nil {
+					// the protocol is decided by the first request of
+					// the connection
+					reqRes.protocol = frt.protocol()
+					frt = nil
+				}
+				if hclient == nil {
+					reqs++
+					if reqs%config.bmNewConn == 0 {
+						destroyClient(conn)
+						conn = nil
+					}
+				}
 				ctx.cancel = cancel
 				select {
 				case <-done:
+					if hclient == nil && conn != nil {
+						destroyClient(conn)
+					}
 					reqWg.Done()
 					reqCtxCh <- ctx
 					return
@@ -280,4 +520,10 @@ func runReqsInParallel(hclient *http.Client, pStat **bmStat, wg *sync.WaitGroup,
 		}
 	}
 endloop:
+	if hclient == nil {
+		return
+	}
+	if rt, ok := hclient.Transport.(*fallbackRoundTripper); ok {
+		stat.protocols = map[string]int{rt.protocol(): 1}
+	}
 }
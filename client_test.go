@@ -6,8 +6,12 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
@@ -16,11 +20,13 @@ import (
 	"math/big"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -28,8 +34,12 @@ import (
 	"testing"
 	"time"
 
+	quic "github.com/lucas-clemente/quic-go"
+	iquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 var (
@@ -74,7 +84,14 @@ func generateTLSConfig() *tls.Config {
 	if err != nil {
 		panic(err)
 	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		// the TLS session can't be resumed if the certificate is expired
+		NotAfter: time.Now().Add(24 * time.Hour),
+		// allow the certificate to be verified with -cacert
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:    []string{"www.test.com"},
+	}
 	certDER, err := x509.CreateCertificate(rand.Reader, &template,
 		&template, &key.PublicKey, key)
 	if err != nil {
@@ -1104,3 +1121,2080 @@ func (suite *ClientSuite) TestBenchmarkCancelled() {
 	}
 	<-done
 }
+
+func (suite *ClientSuite) TestHTTP3() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("proto", r.Proto)
+		w.Write([]byte(r.Method + " " + r.RequestURI))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.headersIncluded = true
+	config.address += "/xxx"
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.True(t, bytes.Contains(b.Bytes(), []byte("HTTP/3.0 200 OK\r\n")))
+		assert.True(t, bytes.Contains(b.Bytes(), []byte("Proto: HTTP/3.0\r\n")))
+		assert.True(t, bytes.HasSuffix(b.Bytes(), []byte("\r\n\r\nGET /xxx")))
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3ConnectTimeout() {
+	config.http3 = true
+	config.address = addrNotListened
+	config.connectTimeout = 10 * time.Millisecond
+
+	t := suite.T()
+	err := run(&bytes.Buffer{})
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasSuffix(err.Error(), ": connect timeout"), err.Error())
+}
+
+func (suite *ClientSuite) TestHTTP3Benchmark() {
+	config.http3 = true
+	config.bmEnabled = true
+	config.bmDuration = 100 * time.Millisecond
+	config.bmConn = 2
+	config.bmReqPerConn = 2
+	count := int32(0)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.Write([]byte("hello world"))
+	})
+	done := startH3Server(handler)
+
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		output := b.String()
+		assert.True(t, strings.Contains(output, fmt.Sprintf("%d requests in ", count)),
+			fmt.Sprintf("mismatch %d", count))
+		assert.False(t, strings.Contains(output, "Errors:"))
+		fmt.Println(output)
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestVersionNegotiationFailed() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	done := startServerWithQUICConfig(handler, &quic.Config{
+		Versions: []quic.VersionNumber{quic.VersionNumber(Version39)},
+	})
+
+	config.quicVersion = Version43
+	t := suite.T()
+	err := run(&bytes.Buffer{})
+	done <- struct{}{}
+	if err == nil {
+		assert.Fail(t, "should fail")
+	} else {
+		assert.Equal(t, "Get \""+config.address+"\": no compatible QUIC version found: "+
+			"offered gQUIC 43, server advertised gQUIC 39", err.Error())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3VersionNegotiationFailed() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	done := startH3ServerWithQUICConfig(handler, &iquic.Config{
+		Versions: []iquic.Version{iquic.Version1},
+	})
+
+	config.http3 = true
+	config.quicVersion = Version2
+	t := suite.T()
+	err := run(&bytes.Buffer{})
+	done <- struct{}{}
+	if err == nil {
+		assert.Fail(t, "should fail")
+	} else {
+		assert.Equal(t, "Get \""+config.address+"\": no compatible QUIC version found: "+
+			"offered QUIC v2, server advertised QUIC v1", err.Error())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestProbe() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Alt-Svc", `h3=":28443"; ma=60`)
+	})
+	done := startH3Server(handler)
+
+	config.probe = true
+	config.connectTimeout = 50 * time.Millisecond
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		output := b.String()
+		lines := strings.Split(output, "\n")
+		assert.Equal(t, "Probing "+config.address, lines[0])
+		assert.Regexp(t, `^QUIC v1 +OK +\S+ +h3 +TLS 1\.3 +TLS_\w+`, lines[2])
+		assert.Regexp(t, `^QUIC v2 +OK +\S+ +h3 +TLS 1\.3 +TLS_\w+`, lines[3])
+		assert.Regexp(t, `^gQUIC 44 +FAIL +- +- +- +-`, lines[4])
+		assert.Contains(t, output, "\nQUIC v1:\n  Status: 200\n  Certificate chain:\n    0 subject: ")
+		assert.Contains(t, output, "  Alt-Svc: h3=\":28443\"; ma=60\n")
+		assert.Contains(t, output, "\ngQUIC 39:\n  Error: Get \""+config.address+"\": connect timeout\n")
+	}
+	// the config is restored after probing each version
+	assert.Equal(t, VersionNumber(0), config.quicVersion)
+	assert.False(t, config.http3)
+	<-done
+}
+
+func (suite *ClientSuite) TestProbeHTTP3() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	done := startH3Server(handler)
+
+	config.probe = true
+	config.http3 = true
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		output := b.String()
+		assert.Contains(t, output, "\nQUIC v1 ")
+		assert.Contains(t, output, "\nQUIC v2 ")
+		assert.NotContains(t, output, "gQUIC")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestProbeAllFailed() {
+	config.probe = true
+	config.http3 = true
+	config.connectTimeout = 50 * time.Millisecond
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	if err == nil {
+		assert.Fail(t, "should fail")
+	} else {
+		assert.Equal(t, "failed to handshake with "+config.address+
+			" via any of QUIC v1, QUIC v2", err.Error())
+	}
+	assert.Regexp(t, `\nQUIC v1 +FAIL `, b.String())
+}
+
+func (suite *ClientSuite) TestProbeJSON() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	done := startServer(handler)
+
+	config.probe = true
+	config.probeJSON = true
+	config.quicVersion = Version43
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		var results []map[string]interface{}
+		assert.Nil(t, json.Unmarshal(b.Bytes(), &results))
+		assert.Equal(t, 1, len(results))
+		res := results[0]
+		assert.Equal(t, "gQUIC 43", res["version"])
+		assert.Equal(t, true, res["success"])
+		assert.Equal(t, float64(200), res["status_code"])
+		assert.Equal(t, 1, len(res["certificates"].([]interface{})))
+		assert.Nil(t, res["alpn"])
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestAltSvc() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Alt-Svc", `h3-29=":28443", h3=":28443"; ma=60`)
+		w.Write([]byte(r.Proto))
+	})
+	tcpDone := startTCPServer(handler)
+	done := startH3Server(handler)
+
+	config.altSvc = true
+	config.address = "https://" + resolveAddr("127.0.0.1:28443", config)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	tcpDone <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "HTTP/3.0", b.String())
+		assert.True(t, config.http3)
+	}
+	<-done
+	<-tcpDone
+}
+
+func (suite *ClientSuite) TestAltSvcNotAdvertised() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Alt-Svc", `h3-29=":28443"`)
+		w.Write([]byte(r.Proto))
+	})
+	tcpDone := startTCPServer(handler)
+
+	config.altSvc = true
+	config.address = "https://" + resolveAddr("127.0.0.1:28443", config)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	tcpDone <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "HTTP/2.0", b.String())
+	}
+	<-tcpDone
+}
+
+func (suite *ClientSuite) TestAltSvcCache() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	done := startH3Server(handler)
+
+	_, fn := createTmpFile("127.0.0.1:28443\th3\t:28443\t4102444800\n")
+	defer os.Remove(fn)
+	config.altSvc = true
+	config.altSvcCache = fn
+	config.address = "https://" + resolveAddr("127.0.0.1:28443", config)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	// no TCP server, so the cached Alt-Svc must be used
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "HTTP/3.0", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestFallbackTCP() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Proto + " " + string(data)))
+	})
+	done := startTCPServer(handler)
+
+	config.http3 = true
+	config.fallbackTCP = true
+	config.connectTimeout = 50 * time.Millisecond
+	config.data.Set("abc")
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "HTTP/2.0 abc", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestFallbackTCPReopenBody() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Proto + " " + string(data)))
+	})
+	done := startTCPServer(handler)
+
+	_, fn := createTmpFile("abc")
+	defer os.Remove(fn)
+	config.http3 = true
+	config.fallbackTCP = true
+	config.connectTimeout = 50 * time.Millisecond
+	t := suite.T()
+	cm, err := createCookieManager()
+	assert.Nil(t, err)
+	nc, err := createNormalClient(cm, nil)
+	assert.Nil(t, err)
+	// the body is not given via -d, and it is closed by the failed QUIC attempt
+	req, _, err := createReqFrom(&reqSpec{
+		method:  http.MethodPost,
+		address: config.address,
+		openBody: func() (io.ReadCloser, string, error) {
+			f, err := os.Open(fn)
+			return f, defaultContentType, err
+		},
+	}, nil)
+	assert.Nil(t, err)
+	resp, err := nc.Do(req)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/2.0 abc", string(data))
+	}
+	destroyClient(nc.Client)
+
+	done <- struct{}{}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3FallbackTCPVersionNegotiationFailed() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	done := startH3ServerWithQUICConfig(handler, &iquic.Config{
+		Versions: []iquic.Version{iquic.Version1},
+	})
+	tcpDone := startTCPServer(handler)
+
+	config.http3 = true
+	config.fallbackTCP = true
+	config.quicVersion = Version2
+	t := suite.T()
+	// only the network errors make us fall back to TCP
+	err := run(&bytes.Buffer{})
+	done <- struct{}{}
+	tcpDone <- struct{}{}
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "no compatible QUIC version found")
+	}
+	<-done
+	<-tcpDone
+}
+
+func (suite *ClientSuite) TestFallbackTCPNotNeeded() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.fallbackTCP = true
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "HTTP/3.0", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestFallbackTCPBenchmark() {
+	config.fallbackTCP = true
+	config.connectTimeout = 50 * time.Millisecond
+	config.bmEnabled = true
+	config.bmDuration = 200 * time.Millisecond
+	config.bmConn = 2
+	config.bmReqPerConn = 2
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+	done := startTCPServer(handler)
+
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		output := b.String()
+		assert.Contains(t, output, "  Protocols:\n\tHTTP/2.0 over TCP\t2 connections\n")
+		assert.NotContains(t, output, "Errors:")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3FallbackTCPBenchmarkNewConn() {
+	config.http3 = true
+	config.fallbackTCP = true
+	config.bmEnabled = true
+	config.bmDuration = 100 * time.Millisecond
+	config.bmConn = 1
+	config.bmReqPerConn = 1
+	config.bmNewConn = 1
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+	done := startH3Server(handler)
+
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		output := b.String()
+		// each new connection is counted
+		assert.Regexp(t, `  \d+ new connections\n(?s:.*)  Handshake modes: full \d+\n`, output)
+		assert.Regexp(t, `  Protocols:\n\tHTTP/3\t\d+ connections\n`, output)
+		assert.NotContains(t, output, "Errors:")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestSessionResumptionAnd0RTT() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.http3 = true
+	config.zeroRTT = true
+	config.method = http.MethodGet
+	config.sessionFile = filepath.Join(dir, "session.txt")
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	assert.Equal(t, "hello", b.String())
+	data, err := ioutil.ReadFile(config.sessionFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+
+	// the saved session allows us to send request as early data
+	sessionCache, err = loadSessionCache(config.sessionFile)
+	assert.Nil(t, err)
+	cm, err := createCookieManager()
+	assert.Nil(t, err)
+	hclient, err := createClient(cm)
+	assert.Nil(t, err)
+	tracker := trackEarlyData(hclient)
+	req, _, err := createReq(nil)
+	assert.Nil(t, err)
+	req.Method = to0RTTMethod(req.Method)
+	resp, err := hclient.Do(req)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		resp.Body.Close()
+		assert.True(t, tracker.used0RTT())
+	}
+	destroyClient(hclient)
+	sessionCache = nil
+
+	done <- struct{}{}
+	<-done
+}
+
+func (suite *ClientSuite) TestVerbose0RTT() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.http3 = true
+	config.zeroRTT = true
+	config.method = http.MethodGet
+	config.sessionFile = filepath.Join(dir, "session.txt")
+	t := suite.T()
+	err := run(&bytes.Buffer{})
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+
+	config.verbose = true
+	verbose := &bytes.Buffer{}
+	verboseOut = verbose
+	defer func() { verboseOut = os.Stderr }()
+	sessionCache, err = loadSessionCache(config.sessionFile)
+	assert.Nil(t, err)
+	cm, err := createCookieManager()
+	assert.Nil(t, err)
+	// the client is wrapped with -v, like the one used in normal mode
+	nc, err := createNormalClient(cm, nil)
+	assert.Nil(t, err)
+	tracker := nc.earlyData
+	req, _, err := createReq(nil)
+	assert.Nil(t, err)
+	req.Method = to0RTTMethod(req.Method)
+	resp, err := nc.Do(req)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		resp.Body.Close()
+		assert.True(t, tracker.used0RTT())
+		assert.Contains(t, verbose.String(), "> GET / HTTP/3\n")
+	}
+	destroyClient(nc.Client)
+	sessionCache = nil
+
+	done <- struct{}{}
+	<-done
+}
+
+func (suite *ClientSuite) TestBenchmarkNewConn() {
+	config.bmEnabled = true
+	config.bmDuration = 100 * time.Millisecond
+	config.bmConn = 2
+	config.bmReqPerConn = 2
+	config.bmNewConn = 2
+	count := int32(0)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.Write([]byte("hello world"))
+	})
+	done := startServer(handler)
+
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		output := b.String()
+		assert.Contains(t, output, "  a new connection every 2 requests\n")
+		assert.Contains(t, output, fmt.Sprintf("%d requests in ", count))
+		assert.Regexp(t, `  \d+ new connections\n\s+Item\s+Avg\s+Stdev\s+Max\s+\+/-Stdev\n\s+Handshake `, output)
+		assert.Contains(t, output, "  Handshake Distribution\n")
+		assert.Regexp(t, `  Handshake modes: full \d+\n`, output)
+		assert.NotContains(t, output, "Errors:")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3ZeroRTTRejected() {
+	var served int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.http3 = true
+	config.zeroRTT = true
+	config.method = http.MethodGet
+	config.sessionFile = filepath.Join(dir, "session.txt")
+	t := suite.T()
+	err := run(&bytes.Buffer{})
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	done <- struct{}{}
+	<-done
+
+	// the restarted server can't decrypt the session ticket, so the early
+	// data is rejected
+	tlsConf := tlsCfg.Clone()
+	tlsConf.SessionTicketKey = [32]byte{1}
+	done = startH3ServerWithConfig(handler, tlsConf, nil)
+	config.zeroRTT = true
+	b := &bytes.Buffer{}
+	err = run(b)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	assert.Equal(t, "hello", b.String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&served))
+	assert.False(t, config.zeroRTT)
+
+	done <- struct{}{}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3BenchmarkNewConnWith0RTT() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+	done := startH3Server(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.http3 = true
+	config.zeroRTT = true
+	config.method = http.MethodGet
+	config.sessionFile = filepath.Join(dir, "session.txt")
+	config.bmEnabled = true
+	config.bmDuration = 100 * time.Millisecond
+	config.bmConn = 1
+	config.bmReqPerConn = 1
+	config.bmNewConn = 1
+
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		output := b.String()
+		assert.Regexp(t, `  Handshake modes: full 1, 0-RTT \d+\n`, output)
+		assert.NotContains(t, output, "Errors:")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestWriteOut() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI == "/redirect" {
+			http.Redirect(w, r, "https://www.test.com/", 302)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	done := startServer(handler)
+
+	uri, _ := url.Parse(addrListened)
+	config.revolver.Set("www.test.com:443:" + uri.Host)
+	config.address = addrListened + "/redirect"
+	config.quicVersion = Version43
+	config.writeOut = "\\n%{http_code} %{size_download} %{remote_ip} %{quic_version} " +
+		"%{num_redirects} %{url_effective}\\n" +
+		"%{time_namelookup} %{time_connect} %{time_appconnect} %{time_starttransfer} %{time_total}"
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		lines := strings.Split(b.String(), "\n")
+		assert.Equal(t, "hello", lines[0])
+		assert.Equal(t, "200 5 127.0.0.1 gQUIC 43 1 https://127.0.0.1:28443/", lines[1])
+		assert.Regexp(t, `^0\.\d{6} 0\.\d{6} 0\.\d{6} 0\.\d{6} 0\.\d{6}$`, lines[2])
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestWriteOutNegotiatedVersion() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startServerWithQUICConfig(handler, &quic.Config{
+		Versions: []quic.VersionNumber{quic.VersionNumber(Version39)},
+	})
+
+	config.writeOut = "%{quic_version}"
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hellogQUIC 39", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3WriteOut() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.writeOut = "%{http_code} %{quic_version} %{num_redirects}"
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello200 QUIC v1 0", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3WriteOutWith0RTT() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.http3 = true
+	config.zeroRTT = true
+	config.sessionFile = filepath.Join(dir, "session.txt")
+	config.writeOut = "%{remote_ip} %{quic_version}"
+	t := suite.T()
+	for i := 0; i < 2; i++ {
+		// the second request is sent as early data, before the handshake
+		// is completed
+		b := &bytes.Buffer{}
+		err := run(b)
+		if err != nil {
+			assert.Fail(t, err.Error())
+		} else {
+			assert.Equal(t, "hello127.0.0.1 QUIC v1", b.String())
+		}
+	}
+	sessionCache = nil
+
+	done <- struct{}{}
+	<-done
+}
+
+func (suite *ClientSuite) TestVerbose() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI == "/redirect" {
+			http.SetCookie(w, &http.Cookie{Name: "a", Value: "b"})
+			http.Redirect(w, r, "https://www.test.com/", 302)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	done := startServer(handler)
+
+	verbose := &bytes.Buffer{}
+	verboseOut = verbose
+	defer func() { verboseOut = os.Stderr }()
+	config.verbose = true
+	uri, _ := url.Parse(addrListened)
+	config.revolver.Set("www.test.com:443:" + uri.Host)
+	config.address = addrListened + "/redirect"
+	config.quicVersion = Version43
+	config.sni = "www.test.com"
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+		output := verbose.String()
+		assert.Contains(t, output, "* Connecting to 127.0.0.1:28443, SNI: www.test.com\n"+
+			"* Connected via gQUIC 43\n")
+		assert.Contains(t, output, "> GET /redirect HTTP/2\n> Host: 127.0.0.1:28443\n"+
+			"> Content-Type: application/json\n> User-Agent: quick/"+version+"\n>\n")
+		assert.Contains(t, output, "< HTTP/2.0 302 Found\n")
+		assert.Contains(t, output, "< Set-Cookie: a=b\n")
+		assert.Contains(t, output, "* Cookie stored for 127.0.0.1:28443: a=b\n")
+		assert.Contains(t, output, "* Redirect to https://www.test.com/\n"+
+			"* Resolve www.test.com:443 to 127.0.0.1:28443\n")
+		assert.Contains(t, output, "> GET / HTTP/2\n> Host: 127.0.0.1:28443\n"+
+			"> Cookie: a=b\n")
+		assert.Contains(t, output, "< HTTP/2.0 200 OK\n")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestVerboseFallbackTCP() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	tlsConf := tlsCfg.Clone()
+	tlsConf.NextProtos = []string{"http/1.1"}
+	done := startTCPServerWithTLSConfig(handler, tlsConf)
+
+	verbose := &bytes.Buffer{}
+	verboseOut = verbose
+	defer func() { verboseOut = os.Stderr }()
+	config.verbose = true
+	config.http3 = true
+	config.fallbackTCP = true
+	config.connectTimeout = 50 * time.Millisecond
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+		output := verbose.String()
+		assert.Contains(t, output, "> GET / HTTP/1.1\n")
+		assert.Contains(t, output, "< HTTP/1.1 200 OK\n")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestKeyLogFile() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.http3 = true
+	config.keyLogFile = filepath.Join(dir, "keylog.txt")
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+		data, err := ioutil.ReadFile(config.keyLogFile)
+		assert.Nil(t, err)
+		assert.Contains(t, string(data), "CLIENT_HANDSHAKE_TRAFFIC_SECRET ")
+		assert.Contains(t, string(data), "CLIENT_TRAFFIC_SECRET_0 ")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestQlogDir() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.http3 = true
+	config.qlogDir = filepath.Join(dir, "qlog")
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+		files, err := filepath.Glob(filepath.Join(config.qlogDir, "*.sqlog"))
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(files)) {
+			data, err := ioutil.ReadFile(files[0])
+			assert.Nil(t, err)
+			s := string(data)
+			assert.Contains(t, s, `"transport:packet_sent"`)
+			assert.Contains(t, s, `"transport:packet_received"`)
+			assert.Contains(t, s, `"recovery:metrics_updated"`)
+			assert.Contains(t, s, `"http3:frame_created"`)
+			assert.Contains(t, s, `"http3:frame_parsed"`)
+		}
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3BenchmarkQlogDir() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+	done := startH3Server(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.http3 = true
+	config.qlogDir = dir
+	config.bmEnabled = true
+	config.bmDuration = 100 * time.Millisecond
+	config.bmConn = 2
+	config.bmReqPerConn = 1
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		files, err := filepath.Glob(filepath.Join(dir, "*.sqlog"))
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(files))
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestClientCert() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	})
+	tlsConf := tlsCfg.Clone()
+	tlsConf.ClientAuth = tls.RequireAnyClientCert
+	done := startH3ServerWithConfig(handler, tlsConf, nil)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	certDER, keyDER := generateClientCert("quick")
+	config.http3 = true
+	cert, err := loadClientCert(writeFile(dir, "cert.der", certDER),
+		writeFile(dir, "key.der", keyDER), "DER", "")
+	t := suite.T()
+	assert.Nil(t, err)
+	config.clientCert = cert
+	b := &bytes.Buffer{}
+	err = run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "quick", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestClientCertRejected() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	tlsConf := tlsCfg.Clone()
+	tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConf.ClientCAs = x509.NewCertPool()
+	done := startH3ServerWithConfig(handler, tlsConf, nil)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	certDER, keyDER := generateClientCert("quick")
+	config.http3 = true
+	cert, err := loadClientCert(writeFile(dir, "cert.der", certDER),
+		writeFile(dir, "key.der", keyDER), "DER", "")
+	t := suite.T()
+	assert.Nil(t, err)
+	config.clientCert = cert
+	err = run(&bytes.Buffer{})
+	done <- struct{}{}
+	if assert.NotNil(t, err) {
+		assert.True(t, isHandshakeError(err), err.Error())
+		assert.Equal(t, int32(1), clientCertReported)
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3BenchmarkClientCert() {
+	count := int32(0)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			atomic.AddInt32(&count, 1)
+		}
+		w.Write([]byte("hello world"))
+	})
+	tlsConf := tlsCfg.Clone()
+	tlsConf.ClientAuth = tls.RequireAnyClientCert
+	done := startH3ServerWithConfig(handler, tlsConf, nil)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	certDER, keyDER := generateClientCert("quick")
+	config.http3 = true
+	config.bmEnabled = true
+	config.bmDuration = 100 * time.Millisecond
+	config.bmConn = 2
+	config.bmReqPerConn = 1
+	cert, err := loadClientCert(writeFile(dir, "cert.der", certDER),
+		writeFile(dir, "key.der", keyDER), "DER", "")
+	t := suite.T()
+	assert.Nil(t, err)
+	config.clientCert = cert
+	b := &bytes.Buffer{}
+	err = run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		output := b.String()
+		assert.Contains(t, output, fmt.Sprintf("%d requests in ", count))
+		assert.NotContains(t, output, "Errors:")
+	}
+	<-done
+}
+
+// serverPubKeyPin returns the pin of the test server's public key
+func serverPubKeyPin() string {
+	leaf, err := x509.ParseCertificate(tlsCfg.Certificates[0].Certificate[0])
+	if err != nil {
+		panic(err)
+	}
+	hash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func (suite *ClientSuite) TestHTTP3CACert() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	t := suite.T()
+	config.http3 = true
+	config.insecure = false
+	err := run(&bytes.Buffer{})
+	// the test certificate is not trusted by the system
+	assert.NotNil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: tlsCfg.Certificates[0].Certificate[0],
+	}))
+	config.rootCAs = pool
+	b := &bytes.Buffer{}
+	err = run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestPinnedPubKey() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startServer(handler)
+
+	t := suite.T()
+	config.pinnedPubKeys, _ = parsePinnedPubKey(serverPubKeyPin())
+	b := &bytes.Buffer{}
+	err := run(b)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+	}
+
+	config.pinnedPubKeys, _ = parsePinnedPubKey(
+		"sha256//AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	err = run(&bytes.Buffer{})
+	done <- struct{}{}
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), errPinnedPubKeyMismatched.Error())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3PinnedPubKey() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	t := suite.T()
+	config.http3 = true
+	config.pinnedPubKeys, _ = parsePinnedPubKey(serverPubKeyPin())
+	b := &bytes.Buffer{}
+	err := run(b)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+	}
+
+	config.pinnedPubKeys, _ = parsePinnedPubKey(
+		"sha256//AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	err = run(&bytes.Buffer{})
+	done <- struct{}{}
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), errPinnedPubKeyMismatched.Error())
+	}
+	<-done
+}
+
+func assertCertExported(t *testing.T, fn string) {
+	data, err := ioutil.ReadFile(fn)
+	assert.Nil(t, err)
+	block, _ := pem.Decode(data)
+	if assert.NotNil(t, block) {
+		assert.Equal(t, tlsCfg.Certificates[0].Certificate[0], block.Bytes)
+	}
+}
+
+func (suite *ClientSuite) TestExportCert() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startServer(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.exportCert = filepath.Join(dir, "chain.pem")
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+		assertCertExported(t, config.exportCert)
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3ExportCert() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.http3 = true
+	config.showCert = true
+	config.exportCert = filepath.Join(dir, "chain.pem")
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+		assertCertExported(t, config.exportCert)
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestTLSMaxOverTCP() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	tlsConf := tlsCfg.Clone()
+	tlsConf.MinVersion = tls.VersionTLS13
+	done := startTCPServerWithTLSConfig(handler, tlsConf)
+
+	config.http3 = true
+	config.fallbackTCP = true
+	config.connectTimeout = 50 * time.Millisecond
+	config.rawTLSMax = "1.2"
+	config.tlsMax = tls.VersionTLS12
+	t := suite.T()
+	err := run(&bytes.Buffer{})
+	done <- struct{}{}
+	// rejected by the server
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "(the TLS parameters may be rejected: -tls-max 1.2)")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3Curves() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	tlsConf := tlsCfg.Clone()
+	tlsConf.CurvePreferences = []tls.CurveID{tls.CurveP384}
+	done := startH3ServerWithConfig(handler, tlsConf, nil)
+
+	config.http3 = true
+	config.rawCurves = "P-384"
+	config.curves = []tls.CurveID{tls.CurveP384}
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+	}
+
+	config.rawCurves = "X25519"
+	config.curves = []tls.CurveID{tls.X25519}
+	err = run(&bytes.Buffer{})
+	done <- struct{}{}
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "(the TLS parameters may be rejected: -curves X25519)")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestCiphersOverTCP() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(tls.CipherSuiteName(r.TLS.CipherSuite)))
+	})
+	tlsConf := tlsCfg.Clone()
+	tlsConf.MaxVersion = tls.VersionTLS12
+	// HTTP/2 requires TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	tlsConf.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	done := startTCPServerWithTLSConfig(handler, tlsConf)
+
+	config.http3 = true
+	config.fallbackTCP = true
+	config.connectTimeout = 50 * time.Millisecond
+	config.rawCiphers = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+	config.cipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", b.String())
+	}
+
+	config.rawCiphers = "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"
+	config.cipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+	err = run(&bytes.Buffer{})
+	done <- struct{}{}
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(),
+			"(the TLS parameters may be rejected: -ciphers TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384)")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3BenchmarkQUICParams() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.bmEnabled = true
+	config.bmDuration = 100 * time.Millisecond
+	config.bmConn = 1
+	config.bmReqPerConn = 1
+	config.quicParams = quicParams{
+		initialStreamWindow: 64 << 10,
+		streamWindow:        1 << 20,
+		maxStreams:          10,
+		initialPacketSize:   1400,
+		disablePMTUD:        true,
+	}
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		output := b.String()
+		assert.Contains(t, output, "  QUIC config: stream window 64KB/1MB, "+
+			"connection window 768KB/15MB, max streams 10, max uni streams 100, "+
+			"keep-alive off, handshake timeout 5s, idle timeout 30s, "+
+			"initial packet size 1400, PMTUD off\n")
+		assert.NotContains(t, output, "Errors:")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestLocalPort() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+	done := startServer(handler)
+
+	t := suite.T()
+	config.localIPs = [][]net.IP{{net.ParseIP("127.0.0.1")}}
+	config.localPortMin = 28500
+	config.localPortMax = 28510
+	// the first port is occupied
+	occupied, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 28500})
+	if err != nil {
+		panic(err)
+	}
+	defer occupied.Close()
+	b := &bytes.Buffer{}
+	err = run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "127.0.0.1:28501", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3LocalPort() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+	done := startH3Server(handler)
+
+	t := suite.T()
+	config.http3 = true
+	config.localPortMin = 28500
+	config.localPortMax = 28510
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "127.0.0.1:28500", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3BenchmarkInterface() {
+	var lock sync.Mutex
+	remoteIPs := map[string]bool{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		lock.Lock()
+		remoteIPs[host] = true
+		lock.Unlock()
+		w.Write([]byte("hello world"))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.bmEnabled = true
+	config.bmDuration = 100 * time.Millisecond
+	config.bmConn = 2
+	config.bmReqPerConn = 1
+	config.localIPs = [][]net.IP{{net.ParseIP("127.0.0.1")}, {net.ParseIP("127.0.0.2")}}
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		output := b.String()
+		assert.Contains(t, output, "  connections spread across 2 local addresses\n")
+		assert.NotContains(t, output, "Errors:")
+		assert.Equal(t, map[string]bool{"127.0.0.1": true, "127.0.0.2": true}, remoteIPs)
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestResolveFailover() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startServer(handler)
+
+	// nothing is listened on port 28444
+	config.revolver.Set("www.test.com:443:127.0.0.1:28444,127.0.0.1:28443")
+	config.address = "https://" + resolveAddr("www.test.com:443", config)
+	config.connectTimeout = 100 * time.Millisecond
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3ResolveFailover() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.revolver.Set("www.test.com:443:127.0.0.1:28444,127.0.0.1:28443")
+	config.address = "https://" + resolveAddr("www.test.com:443", config)
+	config.connectTimeout = 100 * time.Millisecond
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+	}
+
+	config.ipv6Only = true
+	err = run(&bytes.Buffer{})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "no IPv6 address for 127.0.0.1")
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3BenchmarkResolveRoundRobin() {
+	var served [2]int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served[0], 1)
+	})
+	done := startH3Server(handler)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.2:28443")
+	if err != nil {
+		panic(err)
+	}
+	server := &http3.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&served[1], 1)
+		}),
+		TLSConfig: http3.ConfigureTLSConfig(tlsCfg.Clone()),
+	}
+	go server.Serve(conn)
+	defer server.Close()
+
+	config.http3 = true
+	config.bmEnabled = true
+	config.bmDuration = 100 * time.Millisecond
+	config.bmConn = 2
+	config.bmReqPerConn = 1
+	config.revolver.Set("www.test.com:443:127.0.0.1:28443,127.0.0.2:28443")
+	config.address = "https://" + resolveAddr("www.test.com:443", config)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err = run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.NotContains(t, b.String(), "Errors:")
+		assert.True(t, atomic.LoadInt32(&served[0]) > 0)
+		assert.True(t, atomic.LoadInt32(&served[1]) > 0)
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestConnectTo() {
+	var lock sync.Mutex
+	var hosts []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		hosts = append(hosts, r.Host)
+		lock.Unlock()
+		if strings.HasPrefix(r.RequestURI, "/redirect") {
+			w.Write([]byte("done"))
+		} else {
+			http.Redirect(w, r, "https://www.test.com:8443/redirect", 302)
+		}
+	})
+	done := startServer(handler)
+
+	config.connectTo.Set("::127.0.0.1:28443")
+	config.address = "https://" + resolveAddr("www.test.com:443", config)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "done", b.String())
+		lock.Lock()
+		assert.Equal(t, []string{"www.test.com", "www.test.com:8443"}, hosts)
+		lock.Unlock()
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3ConnectTo() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.TLS.ServerName))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.connectTo.Set("www.test.com:443:127.0.0.1:28443")
+	config.address = "https://" + resolveAddr("www.test.com:443", config)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "www.test.com www.test.com", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3DNSServers() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	})
+	done := startH3Server(handler)
+	addr, stop := startDNSServer(map[string]net.IP{
+		"www.test.com.": net.ParseIP("127.0.0.1"),
+	})
+	defer stop()
+
+	config.http3 = true
+	config.ipv4Only = true
+	config.dnsResolver = newDNSResolver([]string{addr})
+	config.address = "https://" + resolveAddr("www.test.com:28443", config)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "www.test.com:28443", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHostsFile() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	})
+	done := startServer(handler)
+
+	config.hosts = map[string][]net.IP{"private.test": {net.ParseIP("127.0.0.1")}}
+	config.address = "https://" + resolveAddr("private.test:28443", config)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "private.test:28443", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3HTTPSRR() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.TLS.ServerName))
+	})
+	done := startH3Server(handler)
+	addr, stop := startHTTPSRRServer(map[string][]dnsmessage.Resource{
+		"www.test.com.": {newHTTPSRecord("www.test.com.", 1, ".", alpnParam("h3"),
+			portParam(28443), ipv4HintParam("127.0.0.1"))},
+	})
+	defer stop()
+
+	config.http3 = true
+	config.httpsRR = true
+	config.dnsServers = []string{addr}
+	config.sni = "www.test.com"
+	config.address = "https://" + resolveAddr("www.test.com:443", config)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "https://127.0.0.1:28443", config.address)
+		assert.Equal(t, "www.test.com www.test.com", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3WriteOutWithHostsFile() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.hosts = map[string][]net.IP{"private.test": {net.ParseIP("127.0.0.1")}}
+	config.address = "https://" + resolveAddr("private.test:28443", config)
+	config.writeOut = "%{http_code} %{remote_ip}"
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello200 127.0.0.1", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestMultipleURLs() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	done := startServer(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.urls, _ = expandGlob(addrListened + "/{a,b}/[1-2]")
+	useURL(config.urls[0].url)
+	config.outFilename = filepath.Join(dir, "#1_#2.txt")
+	t := suite.T()
+	err := run(&bytes.Buffer{})
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		for _, name := range []string{"a_1", "a_2", "b_1", "b_2"} {
+			data, _ := ioutil.ReadFile(filepath.Join(dir, name+".txt"))
+			assert.Equal(t, "/"+strings.Replace(name, "_", "/", 1), string(data))
+		}
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestSingleURLFromGlob() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	done := startServer(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.urls, _ = expandGlob(addrListened + "/{a}/[1-1]")
+	useURL(config.urls[0].url)
+	config.outFilename = filepath.Join(dir, "#1_#2.txt")
+	t := suite.T()
+	err := run(&bytes.Buffer{})
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "a_1.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, "/a/1", string(data))
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3MultipleURLs() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr + " "))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.urls = []globURL{{url: addrListened + "/1"}, {url: addrListened + "/2"},
+		{url: "https://127.0.0.1:28444"}, {url: addrListened + "/3"}}
+	useURL(config.urls[0].url)
+	config.connectTimeout = 100 * time.Millisecond
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "1 of 4 URLs failed", err.Error())
+		// the connection is reused
+		addrs := strings.Fields(b.String())
+		assert.Equal(t, 3, len(addrs))
+		assert.Equal(t, addrs[0], addrs[1])
+		assert.Equal(t, addrs[0], addrs[2])
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3MultipleURLsSNI() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName + " "))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.ipv4Only = true
+	config.revolver.Set("www.test.com:28443:127.0.0.1")
+	config.urls = []globURL{{url: "https://www.test.com:28443"}, {url: "https://localhost:28443"}}
+	useURL(config.urls[0].url)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "www.test.com localhost ", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3Parallel() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/1" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(r.URL.Path + "@" + r.RemoteAddr + " "))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.parallel = true
+	config.urls = []globURL{{url: addrListened + "/1"}, {url: addrListened + "/2"},
+		{url: "https://127.0.0.1:28444"}, {url: addrListened + "/3"}}
+	useURL(config.urls[0].url)
+	config.connectTimeout = 100 * time.Millisecond
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "1 of 4 URLs failed", err.Error())
+		fields := strings.Fields(b.String())
+		if assert.Equal(t, 3, len(fields)) {
+			// written in the order they are done
+			assert.True(t, strings.HasPrefix(fields[2], "/1@"))
+			// the connection is shared
+			addr := fields[0][strings.IndexByte(fields[0], '@'):]
+			assert.True(t, strings.HasSuffix(fields[1], addr))
+			assert.True(t, strings.HasSuffix(fields[2], addr))
+		}
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestParallelRedirect() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "https://www.test.com/", 302)
+			return
+		}
+		w.Write([]byte(r.Header.Get("Referer") + "\n"))
+	})
+	done := startServer(handler)
+
+	uri, _ := url.Parse(addrListened)
+	for _, host := range []string{"www.a.com", "www.b.com", "www.test.com"} {
+		config.revolver.Set(host + ":443:" + uri.Host)
+	}
+	config.parallel = true
+	config.parallelOrdered = true
+	config.parallelMax = 50
+	for i := 0; i < 10; i++ {
+		for _, host := range []string{"www.a.com", "www.b.com"} {
+			config.urls = append(config.urls, globURL{url: "https://" + host + "/redirect"})
+		}
+	}
+	useURL(config.urls[0].url)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		// the Referer is the origin of each transfer
+		expected := strings.Repeat("https://www.a.com/redirect\nhttps://www.b.com/redirect\n", 10)
+		assert.Equal(t, expected, b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestParallelOrdered() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a/1" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Write([]byte(r.URL.Path))
+	})
+	done := startServer(handler)
+
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+	config.parallel = true
+	config.parallelOrdered = true
+	config.parallelMax = 2
+	config.headersIncluded = true
+	config.urls, _ = expandGlob(addrListened + "/{a,b}/[1-2]")
+	useURL(config.urls[0].url)
+	config.outFilename = filepath.Join(dir, "#1_#2.txt")
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		// the headers are written in the order of the URLs
+		output := b.String()
+		last := -1
+		for _, path := range []string{"/a/1", "/a/2", "/b/1", "/b/2"} {
+			i := strings.Index(output, "X-Path: "+path)
+			assert.True(t, i > last, output)
+			last = i
+		}
+		for _, name := range []string{"a_1", "a_2", "b_1", "b_2"} {
+			data, _ := ioutil.ReadFile(filepath.Join(dir, name+".txt"))
+			assert.Equal(t, "/"+strings.Replace(name, "_", "/", 1), string(data))
+		}
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestRequestsFileFallbackTCP() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Body", string(data))
+	})
+	done := startTCPServer(handler)
+
+	_, bodyFn := createTmpFile("from file")
+	defer os.Remove(bodyFn)
+	// the first request falls back to TCP after its body file is closed
+	_, fn := createTmpFile(`{"url": "` + addrListened + `", "body": "@` + bodyFn + `"}
+{"url": "` + addrListened + `", "body": "inline"}
+{"url": "` + addrListened + `", "body_base64": "YmFzZTY0"}
+`)
+	defer os.Remove(fn)
+	var err error
+	config.requests, err = loadBatchRequests(fn)
+	suite.Nil(err)
+	config.requestsFile = fn
+	config.http3 = true
+	config.fallbackTCP = true
+	config.connectTimeout = 50 * time.Millisecond
+	config.urls = batchURLs(config.requests)
+	useURL(config.urls[0].url)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err = run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		dec := json.NewDecoder(b)
+		for _, body := range []string{"from file", "inline", "base64"} {
+			var res batchResult
+			if !assert.Nil(t, dec.Decode(&res)) {
+				break
+			}
+			assert.Equal(t, body, res.Headers.Get("X-Body"))
+		}
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3RequestsFile() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+			w.WriteHeader(201)
+		case "/echo":
+			cookie, _ := r.Cookie("session")
+			w.Header().Set("X-Cookie", cookie.Value)
+			w.Header().Set("X-Key", r.Header.Get("X-Key"))
+			io.Copy(w, r.Body)
+		default:
+			w.WriteHeader(404)
+		}
+	})
+	done := startH3Server(handler)
+
+	_, fn := createTmpFile(`{"name": "login", "method": "POST", "url": "` + addrListened + `/login", "expect_status": 201}
+{"method": "PUT", "url": "` + addrListened + `/echo", "headers": {"x-key": "v"}, "body": "hello"}
+{"url": "` + addrListened + `/missing", "expect_status": 200}
+`)
+	defer os.Remove(fn)
+	var err error
+	config.requests, err = loadBatchRequests(fn)
+	suite.Nil(err)
+	config.requestsFile = fn
+	config.http3 = true
+	config.urls = batchURLs(config.requests)
+	useURL(config.urls[0].url)
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err = run(b)
+	done <- struct{}{}
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "1 of 3 requests failed", err.Error())
+		var results []batchResult
+		dec := json.NewDecoder(b)
+		for dec.More() {
+			var res batchResult
+			if !assert.Nil(t, dec.Decode(&res)) {
+				break
+			}
+			results = append(results, res)
+		}
+		if assert.Equal(t, 3, len(results)) {
+			assert.Equal(t, "login", results[0].Name)
+			assert.Equal(t, 201, results[0].Status)
+			assert.Equal(t, "", results[0].Error)
+			assert.True(t, results[0].Timing.Connect > 0)
+
+			assert.Equal(t, 2, results[1].Line)
+			assert.Equal(t, "PUT", results[1].Method)
+			assert.Equal(t, "HTTP/3.0", results[1].Proto)
+			// the cookie manager is shared
+			assert.Equal(t, "s1", results[1].Headers.Get("X-Cookie"))
+			assert.Equal(t, "v", results[1].Headers.Get("X-Key"))
+			assert.Equal(t, int64(5), results[1].BodySize)
+			sum := sha256.Sum256([]byte("hello"))
+			assert.Equal(t, hex.EncodeToString(sum[:]), results[1].BodySHA256)
+			// the connection is reused
+			assert.Equal(t, float64(0), results[1].Timing.Connect)
+			assert.True(t, results[1].Timing.Total > 0)
+
+			assert.Equal(t, 404, results[2].Status)
+			assert.Equal(t, "expected status 200, got 404", results[2].Error)
+		}
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestRetry() {
+	var count int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&count, 1) < 3 {
+			w.WriteHeader(503)
+			w.Write([]byte("busy"))
+			return
+		}
+		w.Write(body)
+	})
+	done := startServer(handler)
+
+	config.data.Set("hello")
+	config.method = http.MethodPost
+	config.retry = 3
+	config.retryDelay = 10 * time.Millisecond
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		// the body is sent again
+		assert.Equal(t, "hello", b.String())
+		assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestRetryExhausted() {
+	var count int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+	})
+	done := startServer(handler)
+
+	config.retry = 2
+	config.retryDelay = 10 * time.Millisecond
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	if assert.Nil(t, err) {
+		// 404 is not transient
+		assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+	}
+
+	config.retryAllErrors = true
+	b.Reset()
+	err = run(b)
+	done <- struct{}{}
+	if assert.Nil(t, err) {
+		// the last response is written
+		assert.Equal(t, "not found", b.String())
+		assert.Equal(t, int32(4), atomic.LoadInt32(&count))
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3RetryAfter() {
+	var count int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(429)
+			return
+		}
+		w.Write([]byte(r.RemoteAddr))
+	})
+	done := startH3Server(handler)
+
+	config.http3 = true
+	config.retry = 1
+	t := suite.T()
+	b := &bytes.Buffer{}
+	start := time.Now()
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		// Retry-After is preferred to the backoff starting from 1s
+		assert.True(t, time.Since(start) < time.Second)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestRetryDelayOverRetryAfter() {
+	var count int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(503)
+			w.Write([]byte("busy"))
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	done := startServer(handler)
+
+	config.retry = 1
+	config.retryDelay = 500 * time.Millisecond
+	config.writeOut = " %{http_code} %{size_download} %{time_total}"
+	t := suite.T()
+	b := &bytes.Buffer{}
+	start := time.Now()
+	err := run(b)
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.True(t, time.Since(start) < 10*time.Second)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+		fields := strings.Fields(b.String())
+		assert.Equal(t, []string{"hello", "200", "5"}, fields[:3])
+		// -w reports the final attempt, without the delay before it
+		total, _ := strconv.ParseFloat(fields[3], 64)
+		assert.True(t, total < 0.5, "time_total %v", total)
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestHTTP3RetryConnectTimeout() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	started := make(chan chan struct{})
+	go func() {
+		// the first attempt times out
+		time.Sleep(150 * time.Millisecond)
+		started <- startH3Server(handler)
+	}()
+
+	config.http3 = true
+	config.connectTimeout = 100 * time.Millisecond
+	config.retry = 5
+	config.retryDelay = 100 * time.Millisecond
+	t := suite.T()
+	b := &bytes.Buffer{}
+	err := run(b)
+	done := <-started
+	done <- struct{}{}
+	if err != nil {
+		assert.Fail(t, err.Error())
+	} else {
+		assert.Equal(t, "hello", b.String())
+	}
+	<-done
+}
+
+func (suite *ClientSuite) TestRetryMaxTime() {
+	config.address = addrNotListened
+	config.connectTimeout = 50 * time.Millisecond
+	config.retry = 100
+	config.retryDelay = 50 * time.Millisecond
+	config.retryMaxTime = 300 * time.Millisecond
+
+	t := suite.T()
+	start := time.Now()
+	err := run(&bytes.Buffer{})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "Get \""+config.address+"\": connect timeout", err.Error())
+		assert.True(t, time.Since(start) < time.Second)
+	}
+}
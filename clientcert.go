@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// loadClientCert loads the client certificate and its private key. The key is
+// read from the certificate file if the keyFile is not given, like curl.
+// Both PEM and DER are supported, and the PEM key can be encrypted with the
+// pass.
+func loadClientCert(certFile, keyFile, certType, pass string) (*tls.Certificate, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	certData, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyData := certData
+	if keyFile != certFile {
+		keyData, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var chain [][]byte
+	var keyDER []byte
+	switch strings.ToUpper(certType) {
+	case "", "PEM":
+		for rest := certData; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type == "CERTIFICATE" {
+				chain = append(chain, block.Bytes)
+			}
+		}
+		if len(chain) == 0 {
+			return nil, fmt.Errorf("no certificate found in %s", certFile)
+		}
+
+		keyDER, err = decodePEMKey(keyData, pass)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", keyFile, err.Error())
+		}
+	case "DER":
+		if keyFile == certFile {
+			return nil, errors.New("the key file is required for DER certificate")
+		}
+		chain = [][]byte{certData}
+		keyDER = keyData
+	default:
+		return nil, fmt.Errorf("unsupported certificate type %s", certType)
+	}
+
+	key, err := parsePrivateKey(keyDER)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyFile, err.Error())
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// let crypto/tls check if the key matches the certificate
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: der,
+		})...)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// decodePEMKey returns the first private key in the data, decrypted with the
+// pass if it is encrypted
+func decodePEMKey(data []byte, pass string) ([]byte, error) {
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, errors.New("encrypted PKCS #8 private key is unsupported")
+		}
+		if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			continue
+		}
+
+		// the legacy encrypted PEM is deprecated but still widely used
+		if !x509.IsEncryptedPEMBlock(block) {
+			return block.Bytes, nil
+		}
+		if pass == "" {
+			return nil, errors.New("the private key is encrypted, please specify -pass")
+		}
+		der, err := x509.DecryptPEMBlock(block, []byte(pass))
+		if err != nil {
+			return nil, err
+		}
+		return der, nil
+	}
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		switch key := key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+			return key, nil
+		default:
+			return nil, errors.New("unknown type of private key in PKCS #8 wrapping")
+		}
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("failed to parse private key")
+}
+
+// clientCertReported makes the certificate be reported once, as there are lots
+// of failed requests in benchmark mode
+var clientCertReported int32
+
+// isHandshakeError says if the err is caused by the TLS alert
+func isHandshakeError(err error) bool {
+	_, ok := tlsAlertOf(err)
+	return ok
+}
+
+// reportClientCert prints the subject of the client certificate presented if
+// the handshake fails, so that we can know which one is rejected
+func reportClientCert(err error) {
+	if config.clientCert == nil || !isHandshakeError(err) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&clientCertReported, 0, 1) {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Client certificate presented: %s\n",
+		config.clientCert.Leaf.Subject)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// generateClientCert generates a self-signed client certificate, and returns
+// the certificate and the private key in DER
+func generateClientCert(cn string) (certDER []byte, keyDER []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err = x509.CreateCertificate(rand.Reader, &template,
+		&template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDER, err = x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return certDER, keyDER
+}
+
+func writeFile(dir, name string, data []byte) string {
+	fn := filepath.Join(dir, name)
+	err := ioutil.WriteFile(fn, data, 0600)
+	if err != nil {
+		panic(err)
+	}
+	return fn
+}
+
+func TestLoadClientCert(t *testing.T) {
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+
+	certDER, keyDER := generateClientCert("quick")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	encryptedBlock, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", keyDER,
+		[]byte("secret"), x509.PEMCipherAES256)
+	assert.Nil(t, err)
+	encryptedKeyPEM := pem.EncodeToMemory(encryptedBlock)
+
+	certFile := writeFile(dir, "cert.pem", certPEM)
+	keyFile := writeFile(dir, "key.pem", keyPEM)
+	bundleFile := writeFile(dir, "bundle.pem", append(keyPEM, certPEM...))
+	encryptedKeyFile := writeFile(dir, "encrypted.pem", encryptedKeyPEM)
+	certDERFile := writeFile(dir, "cert.der", certDER)
+	keyDERFile := writeFile(dir, "key.der", keyDER)
+
+	cases := []struct {
+		cert, key, certType, pass string
+		errMsg                    string
+	}{
+		{cert: certFile, key: keyFile},
+		{cert: bundleFile},
+		{cert: certFile, key: encryptedKeyFile, pass: "secret"},
+		{cert: certDERFile, key: keyDERFile, certType: "der"},
+		{cert: certFile, key: encryptedKeyFile,
+			errMsg: encryptedKeyFile + ": the private key is encrypted, please specify -pass"},
+		{cert: certFile, key: encryptedKeyFile, pass: "wrong",
+			errMsg: encryptedKeyFile + ": x509: decryption password incorrect"},
+		{cert: certFile, errMsg: certFile + ": no private key found"},
+		{cert: keyFile, key: keyFile, errMsg: "no certificate found in " + keyFile},
+		{cert: certDERFile, certType: "DER",
+			errMsg: "the key file is required for DER certificate"},
+		{cert: certFile, key: keyFile, certType: "P12",
+			errMsg: "unsupported certificate type P12"},
+	}
+	for _, c := range cases {
+		cert, err := loadClientCert(c.cert, c.key, c.certType, c.pass)
+		if c.errMsg == "" {
+			if assert.Nil(t, err) {
+				assert.Equal(t, "CN=quick", cert.Leaf.Subject.String())
+			}
+		} else if assert.NotNil(t, err) {
+			assert.Equal(t, c.errMsg, err.Error())
+		}
+	}
+
+	// the key doesn't match the certificate
+	_, anotherKeyDER := generateClientCert("another")
+	anotherKeyFile := writeFile(dir, "another.der", anotherKeyDER)
+	_, err = loadClientCert(certDERFile, anotherKeyFile, "DER", "")
+	assert.NotNil(t, err)
+}
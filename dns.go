@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// parseDNSServers parses the list of DNS servers separated by ',', the port
+// is 53 if not given
+func parseDNSServers(s string) ([]string, error) {
+	var servers []string
+	for _, server := range strings.Split(s, ",") {
+		server = strings.TrimSpace(server)
+		if ip := net.ParseIP(server); ip != nil {
+			servers = append(servers, net.JoinHostPort(server, "53"))
+			continue
+		}
+		host, _, err := net.SplitHostPort(server)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid DNS server %s", server)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// loadHostsFile reads the names and their addresses in the hosts file format,
+// like /etc/hosts
+func loadHostsFile(fn string) (map[string][]net.IP, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hosts := map[string][]net.IP{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// newDNSResolver returns a resolver which sends the queries to the given
+// servers in round-robin, so that the retried query goes to the next one
+func newDNSResolver(servers []string) *net.Resolver {
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			i := atomic.AddUint32(&next, 1) - 1
+			var d net.Dialer
+			return d.DialContext(ctx, network, servers[int(i)%len(servers)])
+		},
+	}
+}
+
+// lookupHost resolves the host via -hosts-file, then -dns-servers or the
+// system resolver
+func lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	if ips, found := config.hosts[strings.ToLower(host)]; found {
+		var res []net.IP
+		for _, ip := range ips {
+			if (!config.ipv4Only || ip.To4() != nil) && (!config.ipv6Only || ip.To4() == nil) {
+				res = append(res, ip)
+			}
+		}
+		if len(res) > 0 {
+			return res, nil
+		}
+	}
+
+	resolver := net.DefaultResolver
+	if config.dnsResolver != nil {
+		resolver = config.dnsResolver
+	}
+	return resolver.LookupIP(ctx, ipNetwork(), host)
+}
+
+// customResolution tells whether the host is resolved via -hosts-file or
+// -dns-servers instead of the system resolver
+func customResolution() bool {
+	return config.hosts != nil || config.dnsResolver != nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startDNSServer starts a DNS server which answers the A queries with the
+// given records. It returns the address of the server.
+func startDNSServer(records map[string]net.IP) (string, func()) {
+	return startDNSServerWithHandler(func(q dnsmessage.Question) ([]dnsmessage.Resource, bool) {
+		ip, found := records[q.Name.String()]
+		if !found || q.Type != dnsmessage.TypeA {
+			return nil, found
+		}
+		var a [4]byte
+		copy(a[:], ip.To4())
+		return []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   60,
+			},
+			Body: &dnsmessage.AResource{A: a},
+		}}, true
+	})
+}
+
+// startDNSServerWithHandler starts a DNS server which answers the queries via
+// the handler. The handler returns false if the name doesn't exist.
+func startDNSServerWithHandler(handler func(q dnsmessage.Question) ([]dnsmessage.Resource, bool)) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) == 0 {
+				continue
+			}
+
+			msg.Header.Response = true
+			msg.Header.Authoritative = true
+			msg.Additionals = nil
+			answers, found := handler(msg.Questions[0])
+			if !found {
+				msg.Header.RCode = dnsmessage.RCodeNameError
+			}
+			msg.Answers = answers
+			resp, err := msg.Pack()
+			if err != nil {
+				panic(err)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func TestParseDNSServers(t *testing.T) {
+	servers, err := parseDNSServers("127.0.0.1, [::1]:5353,::1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1:53", "[::1]:5353", "[::1]:53"}, servers)
+
+	_, err = parseDNSServers("127.0.0.1,dns.test.com:53")
+	assert.Equal(t, "invalid DNS server dns.test.com:53", err.Error())
+	_, err = parseDNSServers("127.0.0.1:x:y")
+	assert.Equal(t, "invalid DNS server 127.0.0.1:x:y", err.Error())
+}
+
+func TestLoadHostsFile(t *testing.T) {
+	_, fn := createTmpFile("# comment\n127.0.0.1 private.test Alias.test. # comment\n" +
+		"::1 private.test\nxxx invalid.test\n\n")
+	defer os.Remove(fn)
+	hosts, err := loadHostsFile(fn)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]net.IP{
+		"private.test": {net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		"alias.test":   {net.ParseIP("127.0.0.1")},
+	}, hosts)
+
+	_, err = loadHostsFile("/not/exists")
+	assert.NotNil(t, err)
+}
+
+func TestLookupHost(t *testing.T) {
+	defer resetArgs()
+	addr, stop := startDNSServer(map[string]net.IP{
+		"private.test.": net.ParseIP("127.0.0.2"),
+	})
+	defer stop()
+	config.dnsResolver = newDNSResolver([]string{addr})
+	config.ipv4Only = true
+
+	ctx := context.Background()
+	ips, err := lookupHost(ctx, "private.test")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.2", ips[0].String())
+	_, err = lookupHost(ctx, "public.test")
+	assert.NotNil(t, err)
+
+	// the hosts file goes first
+	config.hosts = map[string][]net.IP{"private.test": {net.ParseIP("127.0.0.3")}}
+	ips, err = lookupHost(ctx, "Private.test")
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("127.0.0.3")}, ips)
+	config.ipv4Only = false
+	config.ipv6Only = true
+	_, err = lookupHost(ctx, "private.test")
+	// no AAAA record
+	assert.NotNil(t, err)
+}
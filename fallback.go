@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/h2quic"
+	iquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// fallbackRoundTripper sends requests over QUIC, and falls back to TCP once
+// it fails to connect the server via QUIC because of the network, for example,
+// UDP is blocked. After that, all requests are sent over TCP.
+type fallbackRoundTripper struct {
+	quicRT http.RoundTripper
+	tcpRT  *http.Transport
+
+	lock    sync.Mutex
+	fallen  bool
+	dialErr error
+	// the protocol used by the last response over TCP, like HTTP/2.0
+	tcpProto string
+}
+
+func newFallbackRoundTripper(quicRT http.RoundTripper, tcpRT *http.Transport) *fallbackRoundTripper {
+	rt := &fallbackRoundTripper{
+		quicRT: quicRT,
+		tcpRT:  tcpRT,
+	}
+
+	switch qrt := quicRT.(type) {
+	case *h2quic.RoundTripper:
+		dial := qrt.Dial
+		qrt.Dial = func(network, addr string, tlsCfg *tls.Config,
+			cfg *quic.Config) (quic.Session, error) {
+
+			sess, err := dial(network, addr, tlsCfg, cfg)
+			if err != nil && isNetworkError(err) {
+				rt.fallBack(err)
+			}
+			return sess, err
+		}
+	case *http3.Transport:
+		dial := qrt.Dial
+		qrt.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config,
+			cfg *iquic.Config) (*iquic.Conn, error) {
+
+			conn, err := dial(ctx, addr, tlsCfg, cfg)
+			if err != nil && isNetworkError(err) {
+				rt.fallBack(err)
+			}
+			return conn, err
+		}
+	}
+	return rt
+}
+
+// isNetworkError tells if the QUIC dial fails because of the network. The
+// other errors, like the failure of version negotiation or certificate
+// verification, are returned as they are, since TCP won't help.
+func isNetworkError(err error) bool {
+	if errors.Is(err, errConnectTimeout) {
+		return true
+	}
+	// the handshake timeout of both QUIC stacks
+	var timeoutErr interface{ Timeout() bool }
+	if errors.As(err, &timeoutErr) && timeoutErr.Timeout() {
+		return true
+	}
+	// like the ICMP port unreachable
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+func (rt *fallbackRoundTripper) fallBack(err error) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	if rt.fallen {
+		return
+	}
+	rt.fallen = true
+	rt.dialErr = err
+	// there may be lots of connections in benchmark mode, the protocols used
+	// are reported in the final result instead
+	if !config.bmEnabled {
+		fmt.Fprintf(os.Stderr, "Failed to connect via QUIC: %s, fall back to TCP\n",
+			err.Error())
+	}
+}
+
+func (rt *fallbackRoundTripper) isFallen() bool {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	return rt.fallen
+}
+
+// protocol returns the protocol currently used, like "HTTP/3" or
+// "HTTP/2.0 over TCP"
+func (rt *fallbackRoundTripper) protocol() string {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	if !rt.fallen {
+		if _, ok := rt.quicRT.(*http3.Transport); ok {
+			return "HTTP/3"
+		}
+		return "gQUIC"
+	}
+	if rt.tcpProto == "" {
+		return "TCP"
+	}
+	return rt.tcpProto + " over TCP"
+}
+
+func (rt *fallbackRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !rt.isFallen() {
+		resp, err := rt.quicRT.RoundTrip(req)
+		if err == nil || !rt.isFallen() {
+			return resp, err
+		}
+
+		// the body may be consumed by the failed attempt, open a new one
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+
+	resp, err := rt.tcpRT.RoundTrip(req)
+	if err == nil {
+		rt.lock.Lock()
+		rt.tcpProto = resp.Proto
+		rt.lock.Unlock()
+	}
+	return resp, err
+}
+
+func (rt *fallbackRoundTripper) Close() error {
+	rt.tcpRT.CloseIdleConnections()
+	if closer, ok := rt.quicRT.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
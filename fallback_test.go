@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go/qerr"
+	iquic "github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsNetworkError(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://test.com", Err: err}
+	}
+	assert.True(t, isNetworkError(errConnectTimeout))
+	assert.True(t, isNetworkError(&iquic.HandshakeTimeoutError{}))
+	assert.True(t, isNetworkError(qerr.Error(qerr.HandshakeTimeout, "timeout")))
+	assert.True(t, isNetworkError(&net.OpError{Op: "read", Net: "udp",
+		Err: errors.New("connection refused")}))
+
+	assert.False(t, isNetworkError(&versionNegotiationError{}))
+	assert.False(t, isNetworkError(errPinnedPubKeyMismatched))
+	assert.False(t, isNetworkError(wrap(x509.UnknownAuthorityError{})))
+	assert.False(t, isNetworkError(qerr.Error(qerr.ProofInvalid, "bad cert")))
+	assert.False(t, isNetworkError(&iquic.TransportError{Remote: true}))
+}
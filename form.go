@@ -38,6 +38,9 @@ func (f *form) String() string {
 
 type formValue struct {
 	forms []*form
+	// the same boundary is used each time the body is opened, so that the
+	// reopened body matches the Content-Type already sent
+	boundary string
 }
 
 func (fv *formValue) String() string {
@@ -148,6 +151,9 @@ func (fv *formValue) Set(raw string) error {
 	}
 
 	fv.forms = append(fv.forms, f)
+	if fv.boundary == "" {
+		fv.boundary = multipart.NewWriter(io.Discard).Boundary()
+	}
 	return nil
 }
 
@@ -191,6 +197,9 @@ func unescapeIfNeeded(s string, need *bool) string {
 func (fv *formValue) Open() (io.ReadCloser, string, error) {
 	pipeR, pipeW := io.Pipe()
 	multipartW := multipart.NewWriter(pipeW)
+	if fv.boundary != "" {
+		_ = multipartW.SetBoundary(fv.boundary)
+	}
 	go func() {
 		for _, form := range fv.forms {
 			h := make(textproto.MIMEHeader)
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxGlobURLs limits the number of URLs expanded from a glob pattern
+const maxGlobURLs = 100000
+
+// globURL is a URL expanded from the glob pattern, with the values matched by
+// each glob, which are referred as #1, #2... in -o
+type globURL struct {
+	url    string
+	values []string
+}
+
+// parseGlobRange parses the range like 1-100, 001-100:10 or a-z. The numbers
+// are padded with zero to the width of the start.
+func parseGlobRange(s string) ([]string, error) {
+	step := 1
+	if i := strings.IndexByte(s, ':'); i != -1 {
+		var err error
+		step, err = strconv.Atoi(s[i+1:])
+		if err != nil || step <= 0 {
+			return nil, fmt.Errorf("bad range step in [%s]", s)
+		}
+		s = s[:i]
+	}
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("bad range [%s]", s)
+	}
+	start, end := parts[0], parts[1]
+
+	var values []string
+	if len(start) == 1 && len(end) == 1 && isLetter(start[0]) && isLetter(end[0]) {
+		if start[0] > end[0] || isLower(start[0]) != isLower(end[0]) {
+			return nil, fmt.Errorf("bad range [%s]", s)
+		}
+		for c := int(start[0]); c <= int(end[0]); c += step {
+			values = append(values, string(rune(c)))
+		}
+		return values, nil
+	}
+
+	min, err := strconv.Atoi(start)
+	if err != nil || min < 0 {
+		return nil, fmt.Errorf("bad range [%s]", s)
+	}
+	max, err := strconv.Atoi(end)
+	if err != nil || max < min {
+		return nil, fmt.Errorf("bad range [%s]", s)
+	}
+	if (max-min)/step >= maxGlobURLs {
+		return nil, fmt.Errorf("too many URLs in range [%s]", s)
+	}
+	width := 0
+	if len(start) > 1 && start[0] == '0' {
+		width = len(start)
+	}
+	for i := min; i <= max; i += step {
+		values = append(values, fmt.Sprintf("%0*d", width, i))
+	}
+	return values, nil
+}
+
+func isLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isLower(c byte) bool {
+	return 'a' <= c && c <= 'z'
+}
+
+// expandGlob expands the curl style glob pattern, like {a,b,c} sets and
+// [1-100] ranges, into URLs. The '[' without '-' is kept as is, so that
+// the IPv6 address can be used. Use '\' to escape the special characters.
+func expandGlob(pattern string) ([]globURL, error) {
+	// the literal parts and the globs interleaved
+	var parts []string
+	var globs [][]string
+	var lit strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			lit.WriteByte(pattern[i])
+		case '{', '[':
+			closing := byte('}')
+			if c == '[' {
+				closing = ']'
+			}
+			end := strings.IndexByte(pattern[i+1:], closing)
+			if end == -1 {
+				if c == '[' {
+					lit.WriteByte(c)
+					continue
+				}
+				return nil, fmt.Errorf("unmatched '%c' in %s", c, pattern)
+			}
+			content := pattern[i+1 : i+1+end]
+
+			var values []string
+			if c == '{' {
+				values = strings.Split(content, ",")
+			} else if strings.IndexByte(content, '-') == -1 {
+				// like the IPv6 address
+				lit.WriteString(pattern[i : i+2+end])
+				i += 1 + end
+				continue
+			} else {
+				var err error
+				values, err = parseGlobRange(content)
+				if err != nil {
+					return nil, err
+				}
+			}
+			parts = append(parts, lit.String())
+			lit.Reset()
+			globs = append(globs, values)
+			i += 1 + end
+		default:
+			lit.WriteByte(c)
+		}
+	}
+	parts = append(parts, lit.String())
+
+	total := 1
+	for _, values := range globs {
+		total *= len(values)
+		if total > maxGlobURLs {
+			return nil, errors.New("too many URLs in " + pattern)
+		}
+	}
+
+	urls := make([]globURL, 0, total)
+	indexes := make([]int, len(globs))
+	for {
+		var b strings.Builder
+		values := make([]string, len(globs))
+		for i, glob := range globs {
+			b.WriteString(parts[i])
+			values[i] = glob[indexes[i]]
+			b.WriteString(values[i])
+		}
+		b.WriteString(parts[len(globs)])
+		urls = append(urls, globURL{url: b.String(), values: values})
+
+		// like an odometer, the last glob changes first
+		i := len(globs) - 1
+		for ; i >= 0; i-- {
+			indexes[i]++
+			if indexes[i] < len(globs[i]) {
+				break
+			}
+			indexes[i] = 0
+		}
+		if i < 0 {
+			return urls, nil
+		}
+	}
+}
+
+// maxOutputRef returns the largest N of the #N in the filename, or 0 if not
+// found
+func maxOutputRef(fn string) int {
+	largest := 0
+	for i := 0; i < len(fn); i++ {
+		if fn[i] != '#' {
+			continue
+		}
+		j := i + 1
+		for j < len(fn) && '0' <= fn[j] && fn[j] <= '9' {
+			j++
+		}
+		n, err := strconv.Atoi(fn[i+1 : j])
+		if err == nil && n > largest {
+			largest = n
+		}
+		i = j - 1
+	}
+	return largest
+}
+
+// checkOutput checks that the #N in the filename refers to a glob of each URL,
+// and the URLs are written to different files
+func checkOutput(fn string, urls []globURL) error {
+	n := maxOutputRef(fn)
+	written := make(map[string]string, len(urls))
+	for _, u := range urls {
+		if n > len(u.values) {
+			return fmt.Errorf("#%d refers to a glob not in %s", n, u.url)
+		}
+		name := expandOutput(fn, u.values)
+		if prev, found := written[name]; found {
+			return fmt.Errorf("%s and %s are written to the same file %s", prev, u.url, name)
+		}
+		written[name] = u.url
+	}
+	return nil
+}
+
+// expandOutput replaces #N in the filename with the value of the Nth glob
+func expandOutput(fn string, values []string) string {
+	var b strings.Builder
+	for i := 0; i < len(fn); i++ {
+		if fn[i] == '#' {
+			j := i + 1
+			for j < len(fn) && '0' <= fn[j] && fn[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(fn[i+1 : j])
+			if err == nil && 1 <= n && n <= len(values) {
+				b.WriteString(values[n-1])
+				i = j - 1
+				continue
+			}
+		}
+		b.WriteByte(fn[i])
+	}
+	return b.String()
+}
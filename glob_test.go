@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func globURLs(urls []globURL) []string {
+	res := make([]string, len(urls))
+	for i, u := range urls {
+		res[i] = u.url
+	}
+	return res
+}
+
+func TestExpandGlob(t *testing.T) {
+	urls, err := expandGlob("test.com/{a,b}/[1-2]")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test.com/a/1", "test.com/a/2", "test.com/b/1", "test.com/b/2"},
+		globURLs(urls))
+	assert.Equal(t, []string{"b", "1"}, urls[2].values)
+
+	urls, err = expandGlob("test.com/[08-10]/[a-e:2]")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"test.com/08/a", "test.com/08/c", "test.com/08/e",
+		"test.com/09/a", "test.com/09/c", "test.com/09/e",
+		"test.com/10/a", "test.com/10/c", "test.com/10/e",
+	}, globURLs(urls))
+
+	urls, err = expandGlob("test.com/[0-100:50]")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test.com/0", "test.com/50", "test.com/100"}, globURLs(urls))
+
+	// no glob
+	urls, err = expandGlob("https://[::1]:8443/\\{a\\}")
+	assert.Nil(t, err)
+	assert.Equal(t, []globURL{{url: "https://[::1]:8443/{a}", values: []string{}}}, urls)
+
+	for _, pattern := range []string{
+		"test.com/{a,b", "test.com/[2-1]", "test.com/[a-Z]", "test.com/[1-x]",
+		"test.com/[1-2:0]", "test.com/[0-100000]", "test.com/[0-999]/[0-999]",
+	} {
+		_, err = expandGlob(pattern)
+		assert.NotNil(t, err, pattern)
+	}
+}
+
+func TestExpandOutput(t *testing.T) {
+	assert.Equal(t, "item_a_1.html", expandOutput("item_#1_#2.html", []string{"a", "1"}))
+	assert.Equal(t, "item_#3_#.html", expandOutput("item_#3_#.html", []string{"a", "1"}))
+	assert.Equal(t, "item_a", expandOutput("item_#1", []string{"a"}))
+
+	assert.Equal(t, 12, maxOutputRef("#1_#12_#"))
+	assert.Equal(t, 0, maxOutputRef("item_#.html"))
+}
@@ -1,13 +1,28 @@
 module github.com/spacewander/quick
 
-go 1.12
+go 1.26.0
 
 require (
 	// need to use the same protocol version with Caddy
 	// TODO: find a reasonable way to adapt the protocol change since not everyone
 	// is using Caddy based QUIC server.
 	github.com/lucas-clemente/quic-go v0.10.2
-	github.com/stretchr/testify v1.3.0
+	// for HTTP/3 over IETF QUIC
+	github.com/quic-go/quic-go v0.63.0
+	github.com/stretchr/testify v1.12.1
 	github.com/zoidbergwill/hdrhistogram v0.0.0-20190826083824-4d99d8ade09d
-	golang.org/x/net v0.7.0
+	golang.org/x/net v0.56.0
+)
+
+require (
+	github.com/bifurcation/mint v0.0.0-20180715133206-93c51c6ce115 // indirect
+	github.com/cheekybits/genny v0.0.0-20170328200008-9127e812e1e9 // indirect
+	github.com/hashicorp/golang-lru v0.0.0-20180201235237-0fb14efe8c47 // indirect
+	github.com/lucas-clemente/aes12 v0.0.0-20171027163421-cd47fb39b79f // indirect
+	github.com/lucas-clemente/quic-go-certificates v0.0.0-20160823095156-d2f86524cced // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	go.yaml.in/yaml/v3 v3.0.5 // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
 )
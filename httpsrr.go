@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// the HTTPS record may be larger than 512 bytes, with the hints and ECH config
+const dnsUDPSize = 1232
+
+// maxAliasHops limits the chain of the HTTPS records in AliasMode
+const maxAliasHops = 8
+
+// quicALPN is the ALPN of the QUIC endpoint supported
+const quicALPN = "h3"
+
+// httpsEndpoint is the QUIC endpoint published via the HTTPS record
+type httpsEndpoint struct {
+	target string
+	port   string
+	hints  []net.IP
+}
+
+// addrs returns the addresses to connect, the hints go first
+func (ep *httpsEndpoint) addrs() []string {
+	var addrs []string
+	for _, ip := range ep.hints {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), ep.port))
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, net.JoinHostPort(ep.target, ep.port))
+	}
+	return addrs
+}
+
+// systemDNSServers returns the name servers in /etc/resolv.conf
+func systemDNSServers() []string {
+	servers := []string{}
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = append(servers, "127.0.0.1:53")
+	}
+	return servers
+}
+
+// exchangeDNS sends the query to the server over UDP, and retries over TCP if
+// the response is truncated
+func exchangeDNS(ctx context.Context, server string, query []byte) (*dnsmessage.Message, error) {
+	var d net.Dialer
+	for _, network := range []string{"udp", "tcp"} {
+		conn, err := d.DialContext(ctx, network, server)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+
+		buf := make([]byte, 65535)
+		var n int
+		if network == "udp" {
+			_, err = conn.Write(query)
+			if err == nil {
+				n, err = conn.Read(buf)
+			}
+		} else {
+			msg := make([]byte, 2+len(query))
+			binary.BigEndian.PutUint16(msg, uint16(len(query)))
+			copy(msg[2:], query)
+			_, err = conn.Write(msg)
+			if err == nil {
+				_, err = io.ReadFull(conn, buf[:2])
+			}
+			if err == nil {
+				n = int(binary.BigEndian.Uint16(buf))
+				_, err = io.ReadFull(conn, buf[:n])
+			}
+		}
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var resp dnsmessage.Message
+		err = resp.Unpack(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Header.Truncated {
+			return &resp, nil
+		}
+	}
+	return nil, errors.New("truncated DNS response")
+}
+
+// queryHTTPSRecords returns the HTTPS records of the name
+func queryHTTPSRecords(ctx context.Context, name string) ([]dnsmessage.HTTPSResource, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  dnsmessage.TypeHTTPS,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	var opt dnsmessage.ResourceHeader
+	err = opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false)
+	if err != nil {
+		return nil, err
+	}
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+		Header: opt,
+		Body:   &dnsmessage.OPTResource{},
+	})
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	servers := config.dnsServers
+	if len(servers) == 0 {
+		servers = systemDNSServers()
+	}
+	var resp *dnsmessage.Message
+	for _, server := range servers {
+		resp, err = exchangeDNS(ctx, server, query)
+		if err == nil && resp.Header.ID != id {
+			err = errors.New("mismatched DNS response")
+		}
+		if err == nil && resp.Header.RCode == dnsmessage.RCodeServerFailure {
+			err = fmt.Errorf("%s returned SERVFAIL", server)
+		}
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []dnsmessage.HTTPSResource
+	for _, answer := range resp.Answers {
+		// the CNAME records are followed by the server
+		if rr, ok := answer.Body.(*dnsmessage.HTTPSResource); ok {
+			records = append(records, *rr)
+		}
+	}
+	return records, nil
+}
+
+// lookupHTTPSEndpoint finds the QUIC endpoint of the host:port in its HTTPS
+// records. It returns nil if none is published.
+func lookupHTTPSEndpoint(ctx context.Context, host, port string) (*httpsEndpoint, error) {
+	name := host
+	if port != "443" {
+		name = "_" + port + "._https." + host
+	}
+	// the target "." means the owner name. The host is used instead of the
+	// port-prefixed name, which usually has no address record.
+	owner := host
+
+	for i := 0; i < maxAliasHops; i++ {
+		records, err := queryHTTPSRecords(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].Priority < records[j].Priority
+		})
+
+		var alias string
+		for _, rr := range records {
+			target := strings.TrimSuffix(rr.Target.String(), ".")
+			if target == "" {
+				target = owner
+			}
+			if rr.Priority == 0 {
+				// AliasMode
+				if alias == "" {
+					alias = target
+				}
+				continue
+			}
+
+			if !hasALPN(&rr.SVCBResource, quicALPN) {
+				continue
+			}
+			ep := &httpsEndpoint{target: target, port: port}
+			if value, ok := rr.GetParam(dnsmessage.SVCParamPort); ok && len(value) == 2 {
+				ep.port = fmt.Sprint(binary.BigEndian.Uint16(value))
+			}
+			for _, key := range []dnsmessage.SVCParamKey{
+				dnsmessage.SVCParamIPv4Hint, dnsmessage.SVCParamIPv6Hint,
+			} {
+				value, _ := rr.GetParam(key)
+				size := net.IPv4len
+				if key == dnsmessage.SVCParamIPv6Hint {
+					size = net.IPv6len
+				}
+				for len(value) >= size {
+					ep.hints = append(ep.hints, net.IP(value[:size]))
+					value = value[size:]
+				}
+			}
+			return ep, nil
+		}
+
+		if alias == "" || alias == owner {
+			return nil, nil
+		}
+		name = alias
+		owner = alias
+	}
+	return nil, errors.New("too many HTTPS records in AliasMode")
+}
+
+// hasALPN checks if the alpn is in the ALPN list of the record
+func hasALPN(rr *dnsmessage.SVCBResource, alpn string) bool {
+	value, _ := rr.GetParam(dnsmessage.SVCParamALPN)
+	for len(value) > 0 {
+		size := int(value[0])
+		if len(value) < 1+size {
+			break
+		}
+		if string(value[1:1+size]) == alpn {
+			return true
+		}
+		value = value[1+size:]
+	}
+	return false
+}
+
+// useHTTPSRecord connects the QUIC endpoint published in the HTTPS record of
+// the origin, like the address given via -resolve. The SNI and Host header
+// are still the origin's.
+func useHTTPSRecord() error {
+	authority := originAuthority()
+	if _, found := lookupResolve(authority, config); found {
+		// the address given via -resolve wins
+		return nil
+	}
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.connectTimeout)
+	defer cancel()
+	ep, err := lookupHTTPSEndpoint(ctx, host, port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "HTTPS RR: failed to query %s: %s\n", host, err.Error())
+		return nil
+	}
+	if ep == nil {
+		fmt.Fprintf(os.Stderr, "HTTPS RR: no %s endpoint published by %s\n", quicALPN, host)
+		return nil
+	}
+
+	uri, err := url.Parse(config.address)
+	if err != nil {
+		return err
+	}
+	addrs := strings.Join(ep.addrs(), ",")
+	uri.Host = firstResolvedAddr(addrs, config)
+	config.address = uri.String()
+	fmt.Fprintf(os.Stderr, "HTTPS RR: %s endpoint published by %s, connect to %s\n",
+		quicALPN, host, addrs)
+	return nil
+}
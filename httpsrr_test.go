@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newHTTPSRecord(name string, priority uint16, target string,
+	params ...dnsmessage.SVCParam) dnsmessage.Resource {
+
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeHTTPS,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		},
+		Body: &dnsmessage.HTTPSResource{SVCBResource: dnsmessage.SVCBResource{
+			Priority: priority,
+			Target:   dnsmessage.MustNewName(target),
+			Params:   params,
+		}},
+	}
+}
+
+func alpnParam(alpns ...string) dnsmessage.SVCParam {
+	var value []byte
+	for _, alpn := range alpns {
+		value = append(value, byte(len(alpn)))
+		value = append(value, alpn...)
+	}
+	return dnsmessage.SVCParam{Key: dnsmessage.SVCParamALPN, Value: value}
+}
+
+func portParam(port uint16) dnsmessage.SVCParam {
+	return dnsmessage.SVCParam{Key: dnsmessage.SVCParamPort, Value: []byte{byte(port >> 8), byte(port)}}
+}
+
+func ipv4HintParam(ips ...string) dnsmessage.SVCParam {
+	var value []byte
+	for _, ip := range ips {
+		value = append(value, net.ParseIP(ip).To4()...)
+	}
+	return dnsmessage.SVCParam{Key: dnsmessage.SVCParamIPv4Hint, Value: value}
+}
+
+// startHTTPSRRServer starts a DNS server which answers the HTTPS queries with
+// the given records
+func startHTTPSRRServer(records map[string][]dnsmessage.Resource) (string, func()) {
+	return startDNSServerWithHandler(func(q dnsmessage.Question) ([]dnsmessage.Resource, bool) {
+		rrs, found := records[q.Name.String()]
+		if q.Type != dnsmessage.TypeHTTPS {
+			return nil, found
+		}
+		return rrs, found
+	})
+}
+
+func TestLookupHTTPSEndpoint(t *testing.T) {
+	defer resetArgs()
+	addr, stop := startHTTPSRRServer(map[string][]dnsmessage.Resource{
+		"alias.test.": {newHTTPSRecord("alias.test.", 0, "svc.test.")},
+		"svc.test.": {
+			newHTTPSRecord("svc.test.", 2, "h2.test.", alpnParam("h2")),
+			newHTTPSRecord("svc.test.", 1, ".", alpnParam("h2", "h3"), portParam(28443),
+				ipv4HintParam("127.0.0.1", "127.0.0.2")),
+		},
+		"_8443._https.port.test.": {newHTTPSRecord("_8443._https.port.test.", 1, ".",
+			alpnParam("h3"))},
+		"noh3.test.": {newHTTPSRecord("noh3.test.", 1, ".", alpnParam("h2"))},
+	})
+	defer stop()
+	config.dnsServers = []string{addr}
+
+	ctx := context.Background()
+	ep, err := lookupHTTPSEndpoint(ctx, "alias.test", "443")
+	assert.Nil(t, err)
+	assert.Equal(t, "svc.test", ep.target)
+	assert.Equal(t, []string{"127.0.0.1:28443", "127.0.0.2:28443"}, ep.addrs())
+
+	ep, err = lookupHTTPSEndpoint(ctx, "port.test", "8443")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port.test:8443"}, ep.addrs())
+
+	ep, err = lookupHTTPSEndpoint(ctx, "noh3.test", "443")
+	assert.Nil(t, err)
+	assert.Nil(t, ep)
+	ep, err = lookupHTTPSEndpoint(ctx, "missing.test", "443")
+	assert.Nil(t, err)
+	assert.Nil(t, ep)
+
+	config.dnsServers = []string{"127.0.0.1:1"}
+	_, err = lookupHTTPSEndpoint(ctx, "alias.test", "443")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// keyLogWriter is shared by all connections, nil if no key log file is given
+var keyLogWriter io.Writer
+
+// syncWriter serializes the writes from concurrent connections, so that the
+// lines won't interleave
+type syncWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	return sw.w.Write(p)
+}
+
+// keyLogFile returns the file to write the TLS secrets in NSS key log format,
+// which can be used by Wireshark to decrypt the traffic
+func keyLogFile() string {
+	if config.keyLogFile != "" {
+		return config.keyLogFile
+	}
+	return os.Getenv("SSLKEYLOGFILE")
+}
+
+func openKeyLogFile(fn string) (*os.File, error) {
+	// append to the file like the browsers, so it can be shared with them
+	return os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	quic "github.com/lucas-clemente/quic-go"
+	iquic "github.com/quic-go/quic-go"
+)
+
+// parseInterfaces parses the list of the local addresses separated by ','.
+// Each of them can be an IP address or the name of a network interface, the
+// latter is expanded to the addresses of the interface.
+func parseInterfaces(s string) ([][]net.IP, error) {
+	var res [][]net.IP
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if ip := net.ParseIP(name); ip != nil {
+			res = append(res, []net.IP{ip})
+			continue
+		}
+
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither an IP address nor an interface", name)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		var ips []net.IP
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("interface %s doesn't have any address", name)
+		}
+		res = append(res, ips)
+	}
+	return res, nil
+}
+
+// parseLocalPort parses the port like "9000" or the range like "9000-9100"
+func parseLocalPort(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %s", parts[0])
+	}
+	max := min
+	if len(parts) == 2 {
+		max, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid port %s", parts[1])
+		}
+	}
+	if min <= 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %s", s)
+	}
+	return min, max, nil
+}
+
+// localAddrIndex is used to spread the clients across the local addresses
+var localAddrIndex uint32
+
+func bindLocalAddr() bool {
+	return len(config.localIPs) > 0 || config.localPortMin > 0
+}
+
+// nextLocalIPs returns the addresses which the next client should bind to, in
+// round-robin
+func nextLocalIPs() []net.IP {
+	if len(config.localIPs) == 0 {
+		return nil
+	}
+	i := atomic.AddUint32(&localAddrIndex, 1) - 1
+	return config.localIPs[int(i)%len(config.localIPs)]
+}
+
+// listenUDP creates the UDP socket bound to the address which is in the same
+// family as the remote, and the port in the range given by -local-port
+func listenUDP(localIPs []net.IP, remote *net.UDPAddr) (*net.UDPConn, error) {
+	isIPv4 := remote.IP.To4() != nil
+	var ip net.IP
+	for _, localIP := range localIPs {
+		if (localIP.To4() != nil) == isIPv4 {
+			ip = localIP
+			break
+		}
+	}
+	if ip == nil && len(localIPs) > 0 {
+		return nil, fmt.Errorf("no local address in the same family as %s", remote.IP)
+	}
+
+	if config.localPortMin == 0 {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	}
+	for port := config.localPortMin; port <= config.localPortMax; port++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no available local port in %d-%d",
+		config.localPortMin, config.localPortMax)
+}
+
+// dialGQUICFrom is like quic.DialAddrContext, but the socket is bound to the
+// given local address
+func dialGQUICFrom(ctx context.Context, localIPs []net.IP, addr string,
+	tlsCfg *tls.Config, cfg *quic.Config) (quic.Session, error) {
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenUDP(localIPs, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	verbosef("Bind to %s", conn.LocalAddr())
+
+	sess, err := quic.DialContext(ctx, conn, udpAddr, addr, tlsCfg, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// quic-go only closes the socket created by itself
+	go func() {
+		<-sess.Context().Done()
+		conn.Close()
+	}()
+	return sess, nil
+}
+
+// dialH3From is like iquic.DialAddr, but the socket is bound to the given
+// local address
+func dialH3From(ctx context.Context, localIPs []net.IP, addr string,
+	tlsCfg *tls.Config, cfg *iquic.Config) (*iquic.Conn, error) {
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenUDP(localIPs, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	verbosef("Bind to %s", conn.LocalAddr())
+
+	tr := &iquic.Transport{Conn: conn}
+	dial := tr.Dial
+	if config.zeroRTT {
+		dial = tr.DialEarly
+	}
+	qconn, err := dial(ctx, udpAddr, tlsCfg, cfg)
+	if err != nil {
+		tr.Close()
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		<-qconn.Context().Done()
+		tr.Close()
+		conn.Close()
+	}()
+	return qconn, nil
+}
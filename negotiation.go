@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// a version reserved for greasing, which is guaranteed to trigger a
+	// Version Negotiation packet
+	probeVersion = 0x1a2a3a4a
+	// the server won't reply to Initial packets smaller than this size
+	minInitialPacketSize = 1200
+)
+
+// versionNegotiationError is returned when the server answers with a Version
+// Negotiation packet and none of the versions we offered is acceptable
+type versionNegotiationError struct {
+	offered []VersionNumber
+	// the versions advertised by the server, empty if unknown
+	advertised []VersionNumber
+}
+
+func (e *versionNegotiationError) Error() string {
+	msg := "no compatible QUIC version found: offered " +
+		formatVersions(e.offered)
+	if len(e.advertised) > 0 {
+		msg += ", server advertised " + formatVersions(e.advertised)
+	}
+	return msg
+}
+
+// queryServerVersions sends packets with an unsupported version to the given
+// address, and returns the versions in the replied Version Negotiation packet.
+func queryServerVersions(addr string, timeout time.Duration) ([]VersionNumber, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// IETF QUIC servers only answer the long header packet, while gQUIC servers
+	// prefer the Public Header one. Send both to cover all of them.
+	for _, p := range [][]byte{composeVersionProbe(), composeGQUICVersionProbe()} {
+		_, err = conn.Write(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, fmt.Errorf("no Version Negotiation packet received in %v", timeout)
+			}
+			return nil, err
+		}
+		if versions, ok := parseVersionNegotiation(buf[:n]); ok {
+			return versions, nil
+		}
+	}
+}
+
+func randomConnID() []byte {
+	id := make([]byte, 8)
+	// not critical to have perfect random here
+	_, _ = rand.Read(id)
+	return id
+}
+
+func composeVersionProbe() []byte {
+	p := make([]byte, 0, minInitialPacketSize)
+	p = append(p, 0xc0)
+	p = binary.BigEndian.AppendUint32(p, probeVersion)
+	p = append(p, 8)
+	p = append(p, randomConnID()...)
+	p = append(p, 8)
+	p = append(p, randomConnID()...)
+	// pad with zero
+	return p[:minInitialPacketSize]
+}
+
+func composeGQUICVersionProbe() []byte {
+	p := make([]byte, 0, minInitialPacketSize)
+	// version flag and 8 bytes connection ID
+	p = append(p, 0x1|0x8)
+	p = append(p, randomConnID()...)
+	p = binary.BigEndian.AppendUint32(p, probeVersion)
+	// packet number
+	p = append(p, 1)
+	return p[:minInitialPacketSize]
+}
+
+// parseVersionNegotiation parses the versions from a Version Negotiation
+// packet, in the format of RFC 8999, the IETF draft used by gQUIC 44, or the
+// gQUIC Public Header.
+func parseVersionNegotiation(data []byte) ([]VersionNumber, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+
+	typeByte := data[0]
+	if typeByte&0x80 == 0 {
+		// Public Header, only the Version Negotiation packet sent by the server
+		// has the version flag
+		if typeByte&0x1 == 0 {
+			return nil, false
+		}
+		rest := data[1:]
+		if typeByte&0x8 > 0 {
+			if len(rest) < 8 {
+				return nil, false
+			}
+			rest = rest[8:]
+		}
+		return parseVersionList(rest)
+	}
+
+	if len(data) < 5 || binary.BigEndian.Uint32(data[1:5]) != 0 {
+		return nil, false
+	}
+	rest := data[5:]
+	if versions, ok := parseInvariantVersionNegotiation(rest); ok {
+		return versions, true
+	}
+
+	// the connection ID lengths are encoded into a single byte in the draft
+	if len(rest) == 0 {
+		return nil, false
+	}
+	connIDLen := 0
+	for _, l := range []byte{rest[0] >> 4, rest[0] & 0xf} {
+		if l > 0 {
+			connIDLen += int(l) + 3
+		}
+	}
+	rest = rest[1:]
+	if len(rest) < connIDLen {
+		return nil, false
+	}
+	return parseVersionList(rest[connIDLen:])
+}
+
+func parseInvariantVersionNegotiation(rest []byte) ([]VersionNumber, bool) {
+	// skip the destination and source connection ID
+	for i := 0; i < 2; i++ {
+		if len(rest) == 0 {
+			return nil, false
+		}
+		l := int(rest[0])
+		rest = rest[1:]
+		if len(rest) < l {
+			return nil, false
+		}
+		rest = rest[l:]
+	}
+	return parseVersionList(rest)
+}
+
+func parseVersionList(b []byte) ([]VersionNumber, bool) {
+	if len(b) == 0 || len(b)%4 != 0 {
+		return nil, false
+	}
+	versions := make([]VersionNumber, len(b)/4)
+	for i := range versions {
+		versions[i] = VersionNumber(binary.BigEndian.Uint32(b[4*i:]))
+	}
+	return versions, true
+}
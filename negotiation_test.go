@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	for name, expected := range map[string]VersionNumber{
+		"gQUIC 43": Version43,
+		"gquic39":  Version39,
+		"Q044":     Version44,
+		"v1":       Version1,
+		"QUIC v1":  Version1,
+		"h3":       Version1,
+		"v2":       Version2,
+	} {
+		vn, err := parseVersion(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, vn, name)
+	}
+
+	_, err := parseVersion("h3-29")
+	assert.Equal(t, "QUIC draft-29 is not supported, supported versions: "+
+		"QUIC v1, QUIC v2, gQUIC 44, gQUIC 43, gQUIC 39", err.Error())
+	_, err = parseVersion("gQUIC 46")
+	assert.Equal(t, "gQUIC 46 is not supported, supported versions: "+
+		"QUIC v1, QUIC v2, gQUIC 44, gQUIC 43, gQUIC 39", err.Error())
+	_, err = parseVersion("xxx")
+	assert.Equal(t, "unknown QUIC version xxx, supported versions: "+
+		"QUIC v1, QUIC v2, gQUIC 44, gQUIC 43, gQUIC 39", err.Error())
+}
+
+func TestFormatVersions(t *testing.T) {
+	assert.Equal(t, "QUIC v1, gQUIC 43, 0xff000020",
+		formatVersions([]VersionNumber{Version1, 0x1a2a3a4a, Version43, 0xff000020}))
+}
+
+func appendVersions(b []byte, versions ...VersionNumber) []byte {
+	for _, v := range versions {
+		b = binary.BigEndian.AppendUint32(b, uint32(v))
+	}
+	return b
+}
+
+func TestParseVersionNegotiation(t *testing.T) {
+	connID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// RFC 8999
+	p := append([]byte{0x80, 0, 0, 0, 0, 8}, connID...)
+	p = append(p, 0)
+	p = appendVersions(p, Version1, Version2)
+	versions, ok := parseVersionNegotiation(p)
+	assert.True(t, ok)
+	assert.Equal(t, []VersionNumber{Version1, Version2}, versions)
+
+	// IETF draft used by gQUIC 44
+	p = append([]byte{0x80, 0, 0, 0, 0, 0x50}, connID...)
+	p = appendVersions(p, Version44, Version43)
+	versions, ok = parseVersionNegotiation(p)
+	assert.True(t, ok)
+	assert.Equal(t, []VersionNumber{Version44, Version43}, versions)
+
+	// gQUIC Public Header
+	p = append([]byte{0x1 | 0x8}, connID...)
+	p = appendVersions(p, Version39)
+	versions, ok = parseVersionNegotiation(p)
+	assert.True(t, ok)
+	assert.Equal(t, []VersionNumber{Version39}, versions)
+
+	for _, p := range [][]byte{
+		{},
+		{0x8, 1, 2, 3, 4, 5, 6, 7, 8, 0x51, 0x30, 0x34, 0x33},
+		{0x80, 0, 0, 0, 1, 0},
+		{0x80, 0, 0, 0, 0, 8, 1, 2},
+		append([]byte{0x1 | 0x8}, connID...),
+	} {
+		_, ok = parseVersionNegotiation(p)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// readURLsFile reads the URLs from the file, one per line. The blank lines and
+// the lines starting with '#' are skipped. The fn '-' means stdin.
+func readURLsFile(fn string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if fn != "-" {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// transfer is the request to one of the URLs in parallel mode. The target is
+// taken from the config before the transfers start, since the config can't be
+// changed concurrently.
+type transfer struct {
+	url    string
+	spec   *reqSpec
+	output respOutput
+	client *http.Client
+
+	// the response written to stdout is buffered, so that it won't interleave
+	// with the others
+	stdout   bytes.Buffer
+	received int64
+	err      error
+}
+
+func (t *transfer) do() error {
+	req, cancel, err := createReqFrom(t.spec, nil)
+	if err != nil {
+		return err
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		reportClientCert(err)
+		return explainHandshakeError(err)
+	}
+	resp.Body = &countingReader{rc: resp.Body, n: &t.received}
+	return readRespTo(req, resp, &t.stdout, t.output, make([]byte, 32*1024))
+}
+
+// transferPrinter writes the output of the done transfers, in the order they
+// are done, or in the order of the URLs if -parallel-ordered is given
+type transferPrinter struct {
+	out       io.Writer
+	transfers []*transfer
+	ordered   bool
+
+	lock sync.Mutex
+	done []bool
+	// the index of the next transfer to write in order
+	next int
+}
+
+func (p *transferPrinter) finish(i int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.ordered {
+		p.write(p.transfers[i])
+		return
+	}
+	p.done[i] = true
+	for p.next < len(p.transfers) && p.done[p.next] {
+		p.write(p.transfers[p.next])
+		p.next++
+	}
+}
+
+func (p *transferPrinter) write(t *transfer) {
+	mustWrite(p.out, t.stdout.Bytes())
+	t.stdout = bytes.Buffer{}
+	if t.err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to request %s: %s\n", t.url, t.err.Error())
+	}
+}
+
+// runInParallel requests the URLs concurrently. The client is shared by the
+// URLs with the same SNI, so that the requests to the same authority are sent
+// over the same connection.
+func runInParallel(cm CookieManager, out io.Writer) error {
+	clients := map[string]*normalClient{}
+	defer func() {
+		for _, nc := range clients {
+			destroyClient(nc.Client)
+		}
+	}()
+
+	transfers := make([]*transfer, len(config.urls))
+	for i, u := range config.urls {
+		t := &transfer{url: u.url}
+		transfers[i] = t
+		var nc *normalClient
+		nc, t.err = useNthURL(cm, i, clients, nil)
+		if t.err != nil {
+			continue
+		}
+		// the client is shared by the transfers to the same authority, but
+		// each of them follows the redirects from its own origin
+		hclient := *nc.Client
+		if !config.noRedirect {
+			hclient.CheckRedirect = redirectResolvedFrom(config.originHost)
+		}
+		t.client = &hclient
+		t.spec = configReqSpec()
+		t.output = configRespOutput()
+		if t.output.filename != "" {
+			t.output.filename = expandOutput(t.output.filename, u.values)
+		}
+	}
+
+	printer := &transferPrinter{
+		out:       out,
+		transfers: transfers,
+		ordered:   config.parallelOrdered,
+		done:      make([]bool, len(transfers)),
+	}
+	sem := make(chan struct{}, config.parallelMax)
+	var wg sync.WaitGroup
+	for i, t := range transfers {
+		if t.err != nil {
+			printer.finish(i)
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, t *transfer) {
+			defer wg.Done()
+			t.err = t.do()
+			<-sem
+			printer.finish(i)
+		}(i, t)
+	}
+	wg.Wait()
+
+	if config.dumpCookie != "" {
+		err := cm.Dump(config.dumpCookie)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to dump cookie: "+err.Error())
+		}
+	}
+
+	failed := 0
+	var received int64
+	for _, t := range transfers {
+		if t.err != nil {
+			failed++
+		}
+		received += t.received
+	}
+	fmt.Fprintf(os.Stderr, "Transfers: %d succeeded, %d failed, %d bytes received\n",
+		len(transfers)-failed, failed, received)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d URLs failed", failed, len(transfers))
+	}
+	return nil
+}
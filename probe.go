@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"text/tabwriter"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/h2quic"
+	iquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+type certSummary struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+type probeResult struct {
+	Version string `json:"version"`
+	// whether the handshake succeeded
+	Success       bool          `json:"success"`
+	HandshakeTime time.Duration `json:"handshake_time_ns,omitempty"`
+	ALPN          string        `json:"alpn,omitempty"`
+	TLSVersion    string        `json:"tls_version,omitempty"`
+	CipherSuite   string        `json:"cipher_suite,omitempty"`
+	Certificates  []certSummary `json:"certificates,omitempty"`
+	StatusCode    int           `json:"status_code,omitempty"`
+	AltSvc        []string      `json:"alt_svc,omitempty"`
+	Error         string        `json:"error,omitempty"`
+}
+
+func (pr *probeResult) setCerts(certs []*x509.Certificate) {
+	pr.Certificates = make([]certSummary, len(certs))
+	for i, cert := range certs {
+		pr.Certificates[i] = certSummary{
+			Subject:  cert.Subject.String(),
+			Issuer:   cert.Issuer.String(),
+			NotAfter: cert.NotAfter,
+		}
+	}
+}
+
+func (pr *probeResult) setTLSState(state *tls.ConnectionState) {
+	pr.ALPN = state.NegotiatedProtocol
+	pr.TLSVersion = tls.VersionName(state.Version)
+	pr.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	pr.setCerts(state.PeerCertificates)
+}
+
+// hookDial wraps the Dial of the client's transport, so that we can collect
+// the handshake result.
+func hookDial(hclient *http.Client, res *probeResult) {
+	switch rt := hclient.Transport.(type) {
+	case *h2quic.RoundTripper:
+		dial := rt.Dial
+		rt.Dial = func(network, addr string, tlsCfg *tls.Config,
+			cfg *quic.Config) (quic.Session, error) {
+
+			start := time.Now()
+			sess, err := dial(network, addr, tlsCfg, cfg)
+			if err == nil {
+				res.Success = true
+				res.HandshakeTime = time.Since(start)
+				// gQUIC doesn't use TLS, only the certificates are available
+				res.setCerts(sess.ConnectionState().PeerCertificates)
+			}
+			return sess, err
+		}
+	case *http3.Transport:
+		dial := rt.Dial
+		rt.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config,
+			cfg *iquic.Config) (*iquic.Conn, error) {
+
+			start := time.Now()
+			conn, err := dial(ctx, addr, tlsCfg, cfg)
+			if err == nil {
+				res.Success = true
+				res.HandshakeTime = time.Since(start)
+				state := conn.ConnectionState().TLS
+				res.setTLSState(&state)
+			}
+			return conn, err
+		}
+	}
+}
+
+func probeWithVersion(cm CookieManager, vn VersionNumber) *probeResult {
+	res := &probeResult{Version: vn.String()}
+	quicVersion, http3 := config.quicVersion, config.http3
+	defer func() {
+		config.quicVersion, config.http3 = quicVersion, http3
+	}()
+	config.quicVersion = vn
+	config.http3 = !vn.isGQUIC()
+
+	hclient, err := createClient(cm)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer destroyClient(hclient)
+	hookDial(hclient, res)
+
+	req, cancel, err := createReq(nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if cancel != nil {
+		defer cancel()
+	}
+
+	resp, err := hclient.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	res.StatusCode = resp.StatusCode
+	res.AltSvc = resp.Header["Alt-Svc"]
+	return res
+}
+
+func printProbeResults(results []*probeResult, out io.Writer) {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Version\tResult\tHandshake\tALPN\tTLS\tCipher Suite")
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	for _, res := range results {
+		result := "FAIL"
+		handshake := "-"
+		if res.Success {
+			result = "OK"
+			handshake = formatLatencyDuration(float64(res.HandshakeTime))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", res.Version, result, handshake,
+			orDash(res.ALPN), orDash(res.TLSVersion), orDash(res.CipherSuite))
+	}
+	tw.Flush()
+
+	for _, res := range results {
+		fmt.Fprintf(out, "\n%s:\n", res.Version)
+		if res.StatusCode != 0 {
+			fmt.Fprintf(out, "  Status: %d\n", res.StatusCode)
+		}
+		if len(res.Certificates) > 0 {
+			fmt.Fprintln(out, "  Certificate chain:")
+			for i, cert := range res.Certificates {
+				fmt.Fprintf(out, "    %d subject: %s, issuer: %s, not after: %s\n",
+					i, cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+			}
+		}
+		for _, altSvc := range res.AltSvc {
+			fmt.Fprintf(out, "  Alt-Svc: %s\n", altSvc)
+		}
+		if res.Error != "" {
+			fmt.Fprintf(out, "  Error: %s\n", res.Error)
+		}
+	}
+}
+
+func runInProbeMode(cm CookieManager, out io.Writer) error {
+	var versions []VersionNumber
+	if config.quicVersion != 0 {
+		versions = []VersionNumber{config.quicVersion}
+	} else {
+		for _, vn := range SupportedVersions {
+			// only the IETF QUIC versions are probed with -http3
+			if !config.http3 || !vn.isGQUIC() {
+				versions = append(versions, vn)
+			}
+		}
+	}
+
+	results := make([]*probeResult, len(versions))
+	succeeded := false
+	for i, vn := range versions {
+		results[i] = probeWithVersion(cm, vn)
+		succeeded = succeeded || results[i].Success
+	}
+
+	if config.probeJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(results)
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(out, "Probing %s\n", config.address)
+		printProbeResults(results, out)
+	}
+
+	if !succeeded {
+		return fmt.Errorf("failed to handshake with %s via any of %s",
+			config.address, formatVersions(versions))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	iquic "github.com/quic-go/quic-go"
+	h3qlog "github.com/quic-go/quic-go/http3/qlog"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// qlogFiles tracks the qlog files which are still being written
+var qlogFiles sync.WaitGroup
+
+type qlogFile struct {
+	*bufio.Writer
+	f *os.File
+}
+
+func (qf *qlogFile) Close() error {
+	defer qlogFiles.Done()
+	if err := qf.Flush(); err != nil {
+		qf.f.Close()
+		return err
+	}
+	return qf.f.Close()
+}
+
+// qlogTracer writes the events of each connection to the file named by its
+// original destination connection ID under the dir, in the JSON-SEQ format.
+// Both the QUIC events and the HTTP/3 events are recorded.
+func qlogTracer(dir string) func(context.Context, bool, iquic.ConnectionID) qlogwriter.Trace {
+	return func(_ context.Context, isClient bool, connID iquic.ConnectionID) qlogwriter.Trace {
+		fn := filepath.Join(dir, connID.String()+".sqlog")
+		f, err := os.Create(fn)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create qlog file: %s\n", err.Error())
+			return nil
+		}
+		verbosef("Write qlog to %s", fn)
+
+		qlogFiles.Add(1)
+		fileSeq := qlogwriter.NewConnectionFileSeq(
+			&qlogFile{Writer: bufio.NewWriter(f), f: f},
+			isClient,
+			connID,
+			[]string{qlog.EventSchema, h3qlog.EventSchema},
+		)
+		go fileSeq.Run()
+		return fileSeq
+	}
+}
+
+// waitQlogFiles waits for the qlog files to be flushed, which happens
+// asynchronously after the connections are closed
+func waitQlogFiles() {
+	done := make(chan struct{})
+	go func() {
+		qlogFiles.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		fmt.Fprintln(os.Stderr, "Timed out waiting for the qlog files to be written")
+	}
+}
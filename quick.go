@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -21,6 +23,9 @@ import (
 
 	quic "github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/h2quic"
+	"github.com/lucas-clemente/quic-go/qerr"
+	iquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 )
 
 const (
@@ -60,18 +65,108 @@ type quickConfig struct {
 	headersOnly     bool
 	headersIncluded bool
 	outFilename     string
+	// the format used by -w
+	writeOut string
+	verbose  bool
 
 	insecure bool
 	sni      string
+	// write the TLS secrets to this file, SSLKEYLOGFILE is used if not given
+	keyLogFile string
+	// the client certificate, loaded from certFile and keyFile
+	certFile   string
+	keyFile    string
+	certType   string
+	keyPass    string
+	clientCert *tls.Certificate
+	// trust the CA certificates in caFile and caPath instead of the system ones
+	caFile  string
+	caPath  string
+	rootCAs *x509.CertPool
+	// the sha256 hashes of the server's public key
+	pinnedPubKey  string
+	pinnedPubKeys [][]byte
+	// restrict the TLS parameters offered
+	rawTLSMax    string
+	tlsMax       uint16
+	rawCiphers   string
+	cipherSuites []uint16
+	rawCurves    string
+	curves       []tls.CurveID
+	// print the certificate chain presented by the server
+	showCert   bool
+	exportCert string
+
+	// use HTTP/3 over IETF QUIC instead of HTTP over gQUIC
+	http3 bool
+	// the QUIC version to offer, zero means all supported versions
+	quicVersion VersionNumber
+	rawVersion  string
+
+	sessionFile string
+	// send the request as early data
+	zeroRTT bool
+	// write the qlog of each connection to this directory
+	qlogDir string
 
 	noRedirect bool
+	// fall back to TCP if failed to connect via QUIC
+	fallbackTCP bool
+
+	// the local addresses to bind, given via -interface
+	rawInterface string
+	localIPs     [][]net.IP
+	// the local port range to bind, given via -local-port
+	rawLocalPort string
+	localPortMin int
+	localPortMax int
 
 	connectTimeout time.Duration
 	idleTimeout    time.Duration
 	maxTime        time.Duration
+	// the QUIC transport parameters given via -quic-*
+	quicParams quicParams
 
 	customHeaders headersValue
 	revolver      resolveValue
+	connectTo     connectToValue
+	// all the addresses given via -resolve, keyed by the first one
+	resolvedAddrs map[string][]string
+	// resolve the host via the given DNS servers
+	rawDNSServers string
+	dnsServers    []string
+	dnsResolver   *net.Resolver
+	// connect the QUIC endpoint published in the HTTPS record
+	httpsRR bool
+	// resolve the host via the given hosts file first
+	hostsFile string
+	hosts     map[string][]net.IP
+	// force the address family, via -4 and -6
+	ipv4Only bool
+	ipv6Only bool
+
+	// the URLs expanded from the arguments, the first one is used by default
+	urls []globURL
+	// -sni is given, otherwise the SNI is taken from each URL
+	sniGiven bool
+	// read more URLs from this file, one per line
+	urlsFile string
+	// fetch the URLs concurrently, at most parallelMax at the same time
+	parallel    bool
+	parallelMax int
+	// write the responses to stdout in the order of the URLs
+	parallelOrdered bool
+	// retry the request on the transient errors, like curl's --retry
+	retry          int
+	retryDelay     time.Duration
+	retryMaxTime   time.Duration
+	retryAllErrors bool
+
+	// send the requests described in this file, and write the results to
+	// the resultsFile or stdout
+	requestsFile string
+	requests     []*batchRequest
+	resultsFile  string
 
 	// originHost stores the normalized version of host passed in the uri argument
 	originHost string
@@ -92,6 +187,14 @@ type quickConfig struct {
 	bmConn       int
 	bmReqPerConn int
 	bmEnabled    bool
+	// open a new connection every N requests, zero means never
+	bmNewConn int
+
+	probe     bool
+	probeJSON bool
+
+	altSvc      bool
+	altSvcCache string
 }
 
 func newQuickConfig() *quickConfig {
@@ -104,6 +207,8 @@ func newQuickConfig() *quickConfig {
 		customHeaders: headersValue{hdr: http.Header{}},
 
 		contentType: defaultContentType,
+
+		parallelMax: 50,
 	}
 	return cfg
 }
@@ -114,6 +219,8 @@ var (
 	crlf = []byte{'\r', '\n'}
 
 	showVersion = false
+
+	errConnectTimeout = errors.New("connect timeout")
 )
 
 func init() {
@@ -123,13 +230,110 @@ func init() {
 		"Show response headers only")
 	flag.StringVar(&config.outFilename, "o", config.outFilename,
 		"Write the response body to this file")
+	flag.StringVar(&config.writeOut, "w", config.writeOut,
+		`Write out the information after the operation, like curl's -w. The format can
+be read from file via '@file'. Supported variables: %{time_namelookup},
+%{time_connect}, %{time_appconnect}, %{time_starttransfer}, %{time_total},
+%{http_code}, %{size_download}, %{remote_ip}, %{quic_version},
+%{num_redirects} and %{url_effective}.`)
+	flag.BoolVar(&config.verbose, "v", config.verbose,
+		`Print the request and response headers, and the connection events like
+resolving, redirecting and cookie storing to stderr`)
 	flag.BoolVar(&config.insecure, "k", config.insecure,
 		`Don't verify the certificates when connect to the server.
 This is the default in benchmark mode.`)
 
+	flag.StringVar(&config.keyLogFile, "keylog-file", config.keyLogFile,
+		`Append the TLS secrets to this file in NSS key log format, so that Wireshark can
+decrypt the traffic. The environment variable SSLKEYLOGFILE is used if not given.
+gQUIC doesn't use TLS so nothing will be logged for it.`)
+
+	flag.StringVar(&config.certFile, "cert", config.certFile,
+		`Use the given client certificate file. The private key is read from this file
+if -key is not given. HTTP/3 is used with this option.`)
+	flag.StringVar(&config.keyFile, "key", config.keyFile,
+		"Use the private key in the given file for the client certificate.")
+	flag.StringVar(&config.certType, "cert-type", config.certType,
+		"The type of the client certificate and the private key, PEM or DER.")
+	flag.StringVar(&config.keyPass, "pass", config.keyPass,
+		"The passphrase for the encrypted PEM private key.")
+
+	flag.StringVar(&config.caFile, "cacert", config.caFile,
+		"Verify the server with the CA certificates in the given PEM file, instead of the system ones.")
+	flag.StringVar(&config.caPath, "capath", config.caPath,
+		"Verify the server with the CA certificates in the PEM files under the given directory.")
+	flag.StringVar(&config.pinnedPubKey, "pinnedpubkey", config.pinnedPubKey,
+		`Verify the server's public key with the given sha256 hashes, in the format like
+'sha256//base64;sha256//base64'. It is checked even if -k is given.`)
+
+	flag.StringVar(&config.rawTLSMax, "tls-max", config.rawTLSMax,
+		"The maximum TLS version to offer, 1.2 or 1.3. Note that QUIC requires TLS 1.3.")
+	flag.StringVar(&config.rawCiphers, "ciphers", config.rawCiphers,
+		`The TLS 1.2 cipher suites to offer, separated by ':' or ','. TLS 1.3 cipher
+suites are not configurable, so it only applies to the TLS over TCP and
+requires -fallback-tcp or -alt-svc.`)
+	flag.StringVar(&config.rawCurves, "curves", config.rawCurves,
+		"The key exchange curves to offer, separated by ':' or ',', like 'X25519:P-256'.")
+
+	flag.BoolVar(&config.showCert, "show-cert", config.showCert,
+		`Print the certificate chain presented by the server and the TLS parameters
+negotiated to stderr.`)
+	flag.StringVar(&config.exportCert, "export-cert", config.exportCert,
+		"Export the certificate chain presented by the server as PEM to the given file.")
+
+	flag.BoolVar(&config.http3, "http3", config.http3,
+		`Use HTTP/3 over IETF QUIC (RFC 9114) instead of HTTP over gQUIC.`)
+	flag.StringVar(&config.rawVersion, "quic-version", config.rawVersion,
+		`Specify the QUIC version to offer, like 'gQUIC 43', 'v1' or 'v2'.
+HTTP/3 is used if an IETF QUIC version is given.`)
+
+	flag.StringVar(&config.sessionFile, "session-file", config.sessionFile,
+		`Load TLS sessions from the given file, and write the new sessions back after
+operation, so that the handshake can be resumed. Only HTTP/3 is supported.
+The QUIC address validation tokens are not kept.`)
+	flag.BoolVar(&config.zeroRTT, "0rtt", config.zeroRTT,
+		`Send the GET or HEAD request as 0-RTT early data, and report whether the server
+accepted it. Require -session-file. HTTP/3 is used with this option.`)
+
+	flag.StringVar(&config.qlogDir, "qlog-dir", config.qlogDir,
+		`Write the qlog of each connection to the given directory, named by the
+connection ID. HTTP/3 is used with this option.`)
+
+	flag.BoolVar(&config.altSvc, "alt-svc", config.altSvc,
+		`Send the request over TCP first, then repeat it over QUIC with the
+alternative service advertised via the Alt-Svc header.`)
+	flag.StringVar(&config.altSvcCache, "alt-svc-cache", config.altSvcCache,
+		`Cache the Alt-Svc in the given file, so that the request over TCP can be
+skipped until the Alt-Svc expires. Require -alt-svc.`)
+
+	flag.BoolVar(&config.fallbackTCP, "fallback-tcp", config.fallbackTCP,
+		`Fall back to HTTPS over TCP (HTTP/2 if possible) if failed to connect
+the server via QUIC, for example, UDP is blocked.`)
+
 	flag.BoolVar(&config.noRedirect, "no-redirect", config.noRedirect,
 		"Don't follow redirect. This is the default in benchmark mode.")
 
+	flag.StringVar(&config.rawDNSServers, "dns-servers", config.rawDNSServers,
+		`Resolve the host via the given DNS servers instead of the system ones, in
+ip[:port] format and separated by ','`)
+	flag.StringVar(&config.hostsFile, "hosts-file", config.hostsFile,
+		"Resolve the host via the given file in hosts format first")
+	flag.BoolVar(&config.httpsRR, "https-rr", config.httpsRR,
+		`Query the HTTPS record of the host, and connect the HTTP/3 endpoint published
+in it. The SNI and Host header are not changed`)
+	flag.BoolVar(&config.ipv4Only, "4", config.ipv4Only,
+		"Connect the server via IPv4 addresses only")
+	flag.BoolVar(&config.ipv6Only, "6", config.ipv6Only,
+		"Connect the server via IPv6 addresses only")
+
+	flag.StringVar(&config.rawInterface, "interface", config.rawInterface,
+		`Bind the QUIC socket to the given IP address or the address of the
+interface. In benchmark mode, a list separated by ',' can be given to spread the
+connections across them.`)
+	flag.StringVar(&config.rawLocalPort, "local-port", config.rawLocalPort,
+		`Bind the QUIC socket to the given local port, or the first available one
+in the range like 9000-9100.`)
+
 	timeFmt := ", in the format like 1.5s"
 	flag.DurationVar(&config.connectTimeout, "connect-timeout",
 		config.connectTimeout,
@@ -141,6 +345,30 @@ or is set to zero.`)
 	flag.DurationVar(&config.maxTime, "max-time", config.maxTime,
 		"Maximum time for the whole operation"+timeFmt)
 
+	qp := &config.quicParams
+	sizeFmt := ", in the format like 512KB or 6MB"
+	flag.Var(&qp.initialStreamWindow, "quic-initial-stream-window",
+		"The initial stream-level flow control window"+sizeFmt+". HTTP/3 only.")
+	flag.Var(&qp.streamWindow, "quic-stream-window",
+		"The maximum stream-level flow control window"+sizeFmt)
+	flag.Var(&qp.initialConnWindow, "quic-initial-conn-window",
+		"The initial connection-level flow control window"+sizeFmt+". HTTP/3 only.")
+	flag.Var(&qp.connWindow, "quic-conn-window",
+		"The maximum connection-level flow control window"+sizeFmt)
+	flag.IntVar(&qp.maxStreams, "quic-max-streams", qp.maxStreams,
+		"The maximum number of the bidirectional streams the server can open")
+	flag.IntVar(&qp.maxUniStreams, "quic-max-uni-streams", qp.maxUniStreams,
+		"The maximum number of the unidirectional streams the server can open")
+	flag.DurationVar(&qp.keepAlive, "quic-keep-alive", qp.keepAlive,
+		`Send keep-alive packets in this interval`+timeFmt+`. The interval is not
+configurable for gQUIC, it is half of the idle timeout.`)
+	flag.DurationVar(&qp.handshakeTimeout, "quic-handshake-timeout", qp.handshakeTimeout,
+		"The idle timeout before the handshake is completed"+timeFmt)
+	flag.IntVar(&qp.initialPacketSize, "quic-initial-packet-size", qp.initialPacketSize,
+		"The initial packet size before the path MTU discovery, from 1200 to 1452. HTTP/3 only.")
+	flag.BoolVar(&qp.disablePMTUD, "quic-disable-pmtud", qp.disablePMTUD,
+		"Disable the path MTU discovery. HTTP/3 only.")
+
 	flag.StringVar(&config.sni, "sni", config.sni,
 		"Specify the SNI instead of using the host")
 	flag.StringVar(&config.userAgent, "user-agent", config.userAgent,
@@ -149,7 +377,13 @@ or is set to zero.`)
 	flag.Var(&config.revolver, "resolve",
 		`Provide a custom address for a specific host and port pair in host:port:address
 format. The address part can contain a new port to use. If the specific URL
-doesn't contain a port, the port of the pair is 443`)
+doesn't contain a port, the port of the pair is 443. Multiple addresses separated
+by ',' are tried in order until one of them is connected`)
+	flag.Var(&config.connectTo, "connect-to",
+		`Connect to HOST2:PORT2 instead of HOST1:PORT1, in HOST1:PORT1:HOST2:PORT2
+format. The empty HOST1 or PORT1 matches any host or port, and the empty HOST2 or
+PORT2 keeps the original one. Unlike -resolve, the URL, SNI and Host header are
+not changed, and the redirected requests are mapped too`)
 	flag.StringVar(&config.method, "X", config.method, "Specify request method")
 	flag.Var(&config.data, "d", `Specify HTTP request body data.
 If the request method is not specified, POST will be used.
@@ -176,45 +410,68 @@ described in http://www.cookiecentral.com/faq/#3.5`)
 	flag.StringVar(&config.dumpCookie, "dump-cookie", config.dumpCookie,
 		"Write cookies to the given file after operation")
 
+	flag.IntVar(&config.retry, "retry", config.retry,
+		`Retry the request N times on the transient errors, like connect
+timeout, idle timeout, stream reset and the 408, 429 and 5xx responses.
+The delay before the retry starts from 1s and doubles each time, or follows
+the Retry-After header.`)
+	flag.DurationVar(&config.retryDelay, "retry-delay", config.retryDelay,
+		`Wait for the given time before each retry, instead of backing off or
+following the Retry-After header`)
+	flag.DurationVar(&config.retryMaxTime, "retry-max-time", config.retryMaxTime,
+		"Don't retry once the given time is used since the first request")
+	flag.BoolVar(&config.retryAllErrors, "retry-all-errors", config.retryAllErrors,
+		"Retry on all the errors and the 4xx/5xx responses with -retry")
+
+	flag.StringVar(&config.urlsFile, "urls-file", config.urlsFile,
+		`Read the URLs from the given file, one per line, in addition to the
+ones in the arguments. Use '-' to read from stdin.`)
+	flag.BoolVar(&config.parallel, "parallel", config.parallel,
+		`Fetch the URLs concurrently. The requests to the same host share a
+connection. The response is written to stdout once the transfer is done,
+unless -o is given.`)
+	flag.IntVar(&config.parallelMax, "parallel-max", config.parallelMax,
+		"Maximum number of the concurrent transfers with -parallel")
+	flag.BoolVar(&config.parallelOrdered, "parallel-ordered", config.parallelOrdered,
+		`Write the responses to stdout in the order of the URLs with -parallel,
+instead of the order they are done`)
+
+	flag.StringVar(&config.requestsFile, "requests-file", config.requestsFile,
+		`Send the requests described in the given JSON Lines file one by one,
+instead of the URL. Each line is like {"method": "POST", "url": "test.com",
+"headers": {"X-Key": "value"}, "body": "data or @file", "expect_status": 201}.
+Use "body_base64" for binary body.`)
+	flag.StringVar(&config.resultsFile, "results-file", config.resultsFile,
+		`Write the results of -requests-file to the given file in JSON Lines
+format, instead of stdout`)
+
 	flag.DurationVar(&config.bmDuration, "bm-duration", config.bmDuration,
 		"Duration of the benchmark")
 	flag.IntVar(&config.bmConn, "bm-conn", config.bmConn,
 		"Number of the connections in the benchmark")
 	flag.IntVar(&config.bmReqPerConn, "bm-req-per-conn", config.bmReqPerConn,
 		"Number of the requests to keep in a connection")
+	flag.IntVar(&config.bmNewConn, "bm-new-conn", config.bmNewConn,
+		`Open a new connection every N requests in benchmark mode, to measure the
+handshake. Each of the concurrent requests uses its own connection then.`)
+
+	flag.BoolVar(&config.probeJSON, "json", config.probeJSON,
+		"Print the result of probe in JSON")
 
 	flag.BoolVar(&showVersion, "version", false, "Show version and exit")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [OPTIONS] URL
+       %s [OPTIONS] probe URL
 OPTIONS:
-`, os.Args[0])
+`, os.Args[0], os.Args[0])
 		flag.CommandLine.PrintDefaults()
 	}
 
 }
 
-// for developer
-var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
-
-func checkArgs() error {
-	flag.Parse()
-
-	if showVersion {
-		fmt.Println(version)
-		versions := make([]string, len(SupportedVersions))
-		for i := range versions {
-			versions[i] = SupportedVersions[i].String()
-		}
-		fmt.Printf("Supported QUIC versions: %s\n", strings.Join(versions, ", "))
-		os.Exit(0)
-	}
-
-	if flag.NArg() < 1 {
-		return errors.New("no URL specified")
-	}
-
-	rawURL := flag.Arg(0)
+// parseURL parses the URL given in the command line
+func parseURL(rawURL string) (*url.URL, error) {
 	ok := strings.Contains(rawURL, "://")
 	if !ok {
 		// url.Parse doesn't accept a relative url without scheme, so we have
@@ -224,13 +481,22 @@ func checkArgs() error {
 
 	uri, err := url.Parse(rawURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if uri.Host == "" || uri.Scheme != "https" {
-		return errors.New("URL invalid")
+		return nil, errors.New("URL invalid")
+	}
+	return uri, nil
+}
+
+// useURL makes the URL the target of the requests
+func useURL(rawURL string) error {
+	uri, err := parseURL(rawURL)
+	if err != nil {
+		return err
 	}
 
-	if config.sni == "" {
+	if !config.sniGiven {
 		config.sni = uri.Host
 	}
 
@@ -250,6 +516,80 @@ func checkArgs() error {
 	uri.Host = resolveAddr(uri.Host, config)
 
 	config.address = uri.String()
+	return nil
+}
+
+// for developer
+var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+
+func checkArgs() error {
+	flag.Parse()
+
+	if showVersion {
+		fmt.Println(version)
+		fmt.Printf("Supported QUIC versions: %s\n", formatVersions(SupportedVersions))
+		os.Exit(0)
+	}
+
+	if flag.NArg() < 1 && config.urlsFile == "" && config.requestsFile == "" {
+		return errors.New("no URL specified")
+	}
+
+	if flag.Arg(0) == "probe" {
+		config.probe = true
+		// allow to specify options after the subcommand
+		err := flag.CommandLine.Parse(flag.Args()[1:])
+		if err != nil {
+			return err
+		}
+		if flag.NArg() < 1 {
+			return errors.New("no URL specified")
+		}
+	}
+
+	patterns := flag.Args()
+	if config.urlsFile != "" {
+		lines, err := readURLsFile(config.urlsFile)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -urls-file: %s", err.Error())
+		}
+		patterns = append(patterns, lines...)
+		if len(patterns) == 0 {
+			return errors.New("no URL specified")
+		}
+	}
+
+	config.urls = nil
+	if config.requestsFile != "" {
+		if len(patterns) > 0 {
+			return errors.New("invalid argument: URL can't be given with -requests-file")
+		}
+		requests, err := loadBatchRequests(config.requestsFile)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -requests-file: %s", err.Error())
+		}
+		config.requests = requests
+		config.urls = batchURLs(requests)
+	}
+	for _, pattern := range patterns {
+		urls, err := expandGlob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid argument: %s", err.Error())
+		}
+		for _, u := range urls {
+			_, err = parseURL(u.url)
+			if err != nil {
+				return err
+			}
+		}
+		config.urls = append(config.urls, urls...)
+	}
+
+	config.sniGiven = config.sni != ""
+	err := useURL(config.urls[0].url)
+	if err != nil {
+		return err
+	}
 
 	maxTime := config.maxTime
 	connectTimeout := config.connectTimeout
@@ -281,6 +621,26 @@ func checkArgs() error {
 			idleTimeout)
 	}
 
+	err = config.quicParams.check()
+	if err != nil {
+		return fmt.Errorf("invalid argument: %s", err.Error())
+	}
+
+	if config.rawVersion != "" {
+		vn, err := parseVersion(config.rawVersion)
+		if err != nil {
+			return fmt.Errorf("invalid argument: %s", err.Error())
+		}
+		if vn.isGQUIC() {
+			if config.http3 {
+				return fmt.Errorf("invalid argument: %s can't be used with -http3", vn)
+			}
+		} else {
+			config.http3 = true
+		}
+		config.quicVersion = vn
+	}
+
 	if config.data.Provided() && config.forms.Provided() {
 		return errors.New("invalid argument: -d can't be used with -F")
 	}
@@ -294,15 +654,169 @@ func checkArgs() error {
 			config.method = defaultMethod
 		}
 	} else {
-		config.method = strings.ToUpper(config.method)
-		switch config.method {
-		case http.MethodGet, http.MethodHead, http.MethodDelete,
-			http.MethodPost, http.MethodPatch, http.MethodPut:
-		case http.MethodConnect, http.MethodOptions, http.MethodTrace:
-			return fmt.Errorf("invalid argument: method %s is unsupported",
-				config.method)
-		default:
-			return fmt.Errorf("invalid argument: unknown method %s", config.method)
+		config.method, err = checkMethod(config.method)
+		if err != nil {
+			return fmt.Errorf("invalid argument: %s", err.Error())
+		}
+	}
+
+	if config.zeroRTT {
+		if config.quicVersion.isGQUIC() {
+			return fmt.Errorf("invalid argument: %s can't be used with -0rtt",
+				config.quicVersion)
+		}
+		config.http3 = true
+		if config.sessionFile == "" {
+			return errors.New("invalid argument: -0rtt requires -session-file")
+		}
+		if config.method != http.MethodGet && config.method != http.MethodHead {
+			return fmt.Errorf("invalid argument: -0rtt can't be used with method %s, "+
+				"only GET and HEAD are allowed", config.method)
+		}
+		if config.probe {
+			return errors.New("invalid argument: -0rtt can't be used with probe")
+		}
+		if config.fallbackTCP {
+			return errors.New("invalid argument: -0rtt can't be used with -fallback-tcp")
+		}
+	}
+
+	if config.quicParams.onlyForIETFQUIC() {
+		if config.quicVersion.isGQUIC() {
+			return fmt.Errorf("invalid argument: %s can't be used with -quic-initial-stream-window, "+
+				"-quic-initial-conn-window, -quic-initial-packet-size or -quic-disable-pmtud",
+				config.quicVersion)
+		}
+		config.http3 = true
+	}
+
+	if config.qlogDir != "" {
+		if config.quicVersion.isGQUIC() {
+			return fmt.Errorf("invalid argument: %s can't be used with -qlog-dir",
+				config.quicVersion)
+		}
+		config.http3 = true
+	}
+
+	if config.certFile != "" {
+		if config.quicVersion.isGQUIC() {
+			return fmt.Errorf("invalid argument: %s can't be used with -cert",
+				config.quicVersion)
+		}
+		config.http3 = true
+		config.clientCert, err = loadClientCert(config.certFile, config.keyFile,
+			config.certType, config.keyPass)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -cert: %s", err.Error())
+		}
+	} else if config.keyFile != "" {
+		return errors.New("invalid argument: -key requires -cert")
+	}
+
+	if config.caFile != "" || config.caPath != "" {
+		config.rootCAs, err = loadCertPool(config.caFile, config.caPath)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -cacert/-capath: %s", err.Error())
+		}
+	}
+	if config.pinnedPubKey != "" {
+		config.pinnedPubKeys, err = parsePinnedPubKey(config.pinnedPubKey)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -pinnedpubkey: %s", err.Error())
+		}
+	}
+
+	if config.rawTLSMax != "" || config.rawCurves != "" {
+		// gQUIC doesn't use TLS
+		if config.quicVersion.isGQUIC() {
+			return fmt.Errorf("invalid argument: %s can't be used with -tls-max or -curves",
+				config.quicVersion)
+		}
+		config.http3 = true
+	}
+	if config.rawTLSMax != "" {
+		config.tlsMax, err = parseTLSVersion(config.rawTLSMax)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -tls-max: %s", err.Error())
+		}
+		// QUIC requires TLS 1.3, a lower version only applies to the TLS
+		// over TCP
+		if config.tlsMax < tls.VersionTLS13 && !config.fallbackTCP && !config.altSvc {
+			return fmt.Errorf("invalid argument: -tls-max %s requires -fallback-tcp or -alt-svc, "+
+				"as QUIC requires TLS 1.3", config.rawTLSMax)
+		}
+	}
+	if config.rawCiphers != "" {
+		config.cipherSuites, err = parseCipherSuites(config.rawCiphers)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -ciphers: %s", err.Error())
+		}
+		// the cipher suites of TLS 1.3 used by QUIC are not configurable
+		if !config.fallbackTCP && !config.altSvc {
+			return errors.New("invalid argument: -ciphers requires -fallback-tcp or -alt-svc, " +
+				"as QUIC requires TLS 1.3")
+		}
+	}
+	if config.rawCurves != "" {
+		config.curves, err = parseCurves(config.rawCurves)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -curves: %s", err.Error())
+		}
+	}
+
+	if config.ipv4Only && config.ipv6Only {
+		return errors.New("invalid argument: -4 can't be used with -6")
+	}
+
+	if config.rawDNSServers != "" {
+		servers, err := parseDNSServers(config.rawDNSServers)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -dns-servers: %s", err.Error())
+		}
+		config.dnsServers = servers
+		config.dnsResolver = newDNSResolver(servers)
+	}
+	if config.hostsFile != "" {
+		config.hosts, err = loadHostsFile(config.hostsFile)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -hosts-file: %s", err.Error())
+		}
+	}
+
+	if config.httpsRR {
+		if config.quicVersion.isGQUIC() {
+			return fmt.Errorf("invalid argument: %s can't be used with -https-rr",
+				config.quicVersion)
+		}
+		config.http3 = true
+		if config.altSvc {
+			return errors.New("invalid argument: -https-rr can't be used with -alt-svc")
+		}
+		if config.probe {
+			return errors.New("invalid argument: -https-rr can't be used with probe")
+		}
+	}
+
+	if config.rawInterface != "" {
+		config.localIPs, err = parseInterfaces(config.rawInterface)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -interface: %s", err.Error())
+		}
+	}
+	if config.rawLocalPort != "" {
+		config.localPortMin, config.localPortMax, err = parseLocalPort(config.rawLocalPort)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -local-port: %s", err.Error())
+		}
+	}
+	if bindLocalAddr() {
+		// quic-go doesn't allow gQUIC 44 over the socket created by us
+		if config.quicVersion == Version44 {
+			return fmt.Errorf("invalid argument: %s can't be used with -interface or -local-port",
+				config.quicVersion)
+		}
+		if config.probe {
+			return errors.New("invalid argument: -interface and -local-port can't be used with probe")
 		}
 	}
 
@@ -316,40 +830,351 @@ func checkArgs() error {
 		config.contentType = ct
 	}
 
+	if strings.HasPrefix(config.writeOut, "@") {
+		fn := config.writeOut[1:]
+		var data []byte
+		var err error
+		if fn == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(fn)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid argument: -w: %s", err.Error())
+		}
+		config.writeOut = string(data)
+	}
+	if config.writeOut != "" {
+		err := checkWriteOut(config.writeOut)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -w: %s", err.Error())
+		}
+		if config.probe {
+			return errors.New("invalid argument: -w can't be used with probe")
+		}
+	}
+
+	if config.altSvcCache != "" && !config.altSvc {
+		return errors.New("invalid argument: -alt-svc-cache requires -alt-svc")
+	}
+	if config.probe && config.altSvc {
+		return errors.New("invalid argument: -alt-svc can't be used with probe")
+	}
+	if config.probe && config.fallbackTCP {
+		return errors.New("invalid argument: -fallback-tcp can't be used with probe")
+	}
+	if config.probe && config.verbose {
+		return errors.New("invalid argument: -v can't be used with probe")
+	}
+	if config.probe && (config.showCert || config.exportCert != "") {
+		return errors.New("invalid argument: -show-cert and -export-cert can't be used with probe")
+	}
+
+	if config.bmNewConn < 0 {
+		return fmt.Errorf(
+			"invalid argument: -bm-new-conn should not be negative, got %d",
+			config.bmNewConn)
+	}
+
 	if config.bmConn > 0 && config.bmDuration > 0 && config.bmReqPerConn > 0 {
 		config.bmEnabled = true
 	}
 
 	if config.bmEnabled {
+		if config.probe {
+			return errors.New("invalid argument: probe can't be used in benchmark mode")
+		}
+		if config.altSvc {
+			return errors.New("invalid argument: -alt-svc can't be used in benchmark mode")
+		}
+		if config.verbose {
+			return errors.New("invalid argument: -v can't be used in benchmark mode")
+		}
+		if config.zeroRTT && config.bmNewConn == 0 {
+			return errors.New("invalid argument: -0rtt requires -bm-new-conn in benchmark mode")
+		}
+		if config.showCert || config.exportCert != "" {
+			return errors.New("invalid argument: -show-cert and -export-cert can't be used " +
+				"in benchmark mode")
+		}
 		if config.dumpCookie != "" {
 			return errors.New("unsupport option in benchmark mode")
 		}
-		if config.outFilename != "" || config.headersIncluded || config.headersOnly {
+		if config.outFilename != "" || config.headersIncluded || config.headersOnly ||
+			config.writeOut != "" {
+
 			return errors.New("output customization is not allowed in benchmark mode")
 		}
 		config.noRedirect = true
-		config.insecure = true
+		// verify the server only if the CA is given, the system CA is unlikely
+		// to be used when benchmarking
+		if config.rootCAs == nil {
+			config.insecure = true
+		}
 
 		if config.maxTime == 0 {
 			config.maxTime = config.bmDuration
 		}
 	}
 
+	if config.retry < 0 {
+		return fmt.Errorf("invalid argument: -retry should not be negative, got %d",
+			config.retry)
+	}
+	if config.retryDelay < 0 {
+		return fmt.Errorf("invalid argument: -retry-delay should not be negative, got %v",
+			config.retryDelay)
+	}
+	if config.retryMaxTime < 0 {
+		return fmt.Errorf("invalid argument: -retry-max-time should not be negative, got %v",
+			config.retryMaxTime)
+	}
+	if config.retry > 0 {
+		if config.bmEnabled {
+			return errors.New("invalid argument: -retry can't be used in benchmark mode")
+		}
+		if config.probe {
+			return errors.New("invalid argument: -retry can't be used with probe")
+		}
+		if config.parallel {
+			return errors.New("invalid argument: -retry can't be used with -parallel")
+		}
+		if config.requestsFile != "" {
+			return errors.New("invalid argument: -retry can't be used with -requests-file")
+		}
+	}
+
+	if config.requestsFile != "" {
+		if config.bmEnabled {
+			return errors.New("invalid argument: -requests-file can't be used in benchmark mode")
+		}
+		if config.probe {
+			return errors.New("invalid argument: -requests-file can't be used with probe")
+		}
+		if config.parallel {
+			return errors.New("invalid argument: -requests-file can't be used with -parallel")
+		}
+		if config.data.Provided() || config.forms.Provided() {
+			return errors.New("invalid argument: -requests-file can't be used with -d or -F")
+		}
+		if config.outFilename != "" || config.headersIncluded || config.headersOnly ||
+			config.writeOut != "" {
+
+			return errors.New("invalid argument: output customization is not allowed with -requests-file")
+		}
+		if config.showCert || config.exportCert != "" {
+			return errors.New("invalid argument: -requests-file can't be used with -show-cert or -export-cert")
+		}
+	} else if config.resultsFile != "" {
+		return errors.New("invalid argument: -results-file requires -requests-file")
+	}
+
+	if config.parallel {
+		if config.bmEnabled {
+			return errors.New("invalid argument: -parallel can't be used in benchmark mode")
+		}
+		if config.probe {
+			return errors.New("invalid argument: -parallel can't be used with probe")
+		}
+		if config.parallelMax < 1 {
+			return fmt.Errorf("invalid argument: -parallel-max should be positive, got %d",
+				config.parallelMax)
+		}
+		if config.altSvc {
+			return errors.New("invalid argument: -parallel can't be used with -alt-svc")
+		}
+		if config.zeroRTT {
+			return errors.New("invalid argument: -parallel can't be used with -0rtt")
+		}
+		if config.writeOut != "" {
+			return errors.New("invalid argument: -parallel can't be used with -w")
+		}
+		if config.showCert || config.exportCert != "" {
+			return errors.New("invalid argument: -parallel can't be used with -show-cert or -export-cert")
+		}
+	}
+
+	if len(config.urls) > 1 {
+		if config.bmEnabled {
+			return errors.New("invalid argument: benchmark mode accepts only one URL")
+		}
+		if config.probe {
+			return errors.New("invalid argument: probe accepts only one URL")
+		}
+		if config.altSvc {
+			return errors.New("invalid argument: -alt-svc can't be used with multiple URLs")
+		}
+		if config.zeroRTT {
+			return errors.New("invalid argument: -0rtt can't be used with multiple URLs")
+		}
+		if config.outFilename != "" && !strings.Contains(config.outFilename, "#") {
+			return errors.New("invalid argument: -o should contain #N to write the " +
+				"responses of multiple URLs to separate files")
+		}
+	}
+	if config.outFilename != "" {
+		err = checkOutput(config.outFilename, config.urls)
+		if err != nil {
+			return fmt.Errorf("invalid argument: -o: %s", err.Error())
+		}
+	}
+
 	return nil
 }
 
-func dialWithTimeout(network, addr string, tlsCfg *tls.Config,
-	cfg *quic.Config) (quic.Session, error) {
+// checkMethod returns the method in upper case if it is supported
+func checkMethod(method string) (string, error) {
+	method = strings.ToUpper(method)
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete,
+		http.MethodPost, http.MethodPatch, http.MethodPut:
+		return method, nil
+	case http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return "", fmt.Errorf("method %s is unsupported", method)
+	default:
+		return "", fmt.Errorf("unknown method %s", method)
+	}
+}
+
+// reportFailover tells which address is connected after the others failed
+func reportFailover(failed []string, addr string) {
+	// there may be lots of connections in benchmark mode
+	if len(failed) > 0 && !config.bmEnabled {
+		fmt.Fprintf(os.Stderr, "Failed to connect %s, connected to %s instead\n",
+			strings.Join(failed, ", "), addr)
+	}
+}
+
+// dialTrace is notified of the steps of the dial, like httptrace.ClientTrace
+type dialTrace struct {
+	// resolved is called once the address is resolved
+	resolved func()
+	// gquicConnected is called once the gQUIC session is established, with
+	// the version of the session
+	gquicConnected func(remoteAddr net.Addr, vn VersionNumber)
+}
+
+func (trace *dialTrace) addrResolved() {
+	if trace != nil && trace.resolved != nil {
+		trace.resolved()
+	}
+}
+
+func (trace *dialTrace) gquicSessionConnected(sess quic.Session, vn VersionNumber) {
+	if trace != nil && trace.gquicConnected != nil {
+		trace.gquicConnected(sess.RemoteAddr(), vn)
+	}
+}
+
+func dialWithTimeout(network, addr string, tlsCfg *tls.Config, cfg *quic.Config,
+	localIPs []net.IP, addrIndex int, trace *dialTrace) (quic.Session, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.connectTimeout)
+	addrs, err := lookupAddrs(ctx, addr)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	trace.addrResolved()
+	// the SNI is taken from the address if not given, which may be changed
+	// via -connect-to
+	if tlsCfg.ServerName == "" {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	var failed []string
+	for i := range addrs {
+		a := addrs[(addrIndex+i)%len(addrs)]
+		var sess quic.Session
+		var vn VersionNumber
+		sess, vn, err = dialGQUICWithTimeout(a, tlsCfg, cfg, localIPs)
+		if err == nil {
+			reportFailover(failed, a)
+			trace.gquicSessionConnected(sess, vn)
+			return sess, nil
+		}
+		if _, ok := err.(*versionNegotiationError); ok {
+			// all the addresses are expected to be the same server
+			return nil, err
+		}
+		verbosef("Failed to connect %s: %s", a, err.Error())
+		failed = append(failed, a)
+	}
+	return nil, err
+}
+
+// offeredGQUICVersions returns the gQUIC versions to offer, in the order of
+// preference
+func offeredGQUICVersions(cfg *quic.Config) []VersionNumber {
+	var offered []VersionNumber
+	for _, v := range cfg.Versions {
+		offered = append(offered, VersionNumber(v))
+	}
+	if len(offered) > 0 {
+		return offered
+	}
+	for _, v := range SupportedVersions {
+		// gQUIC 44 can't be used with the socket created by us
+		if v.isGQUIC() && !(v == Version44 && bindLocalAddr()) {
+			offered = append(offered, v)
+		}
+	}
+	return offered
+}
+
+// dialGQUICWithTimeout offers the versions one by one instead of relying on
+// the version negotiation of quic-go, since quic-go doesn't tell us the version
+// of the session. It costs the same round trip as the negotiation if the
+// preferred version is not supported by the server.
+func dialGQUICWithTimeout(addr string, tlsCfg *tls.Config,
+	cfg *quic.Config, localIPs []net.IP) (quic.Session, VersionNumber, error) {
 
 	ctx, cancel :=
 		context.WithTimeout(context.Background(), config.connectTimeout)
 	defer cancel()
 
+	verbosef("Connecting to %s, SNI: %s", addr, sniOf(addr, tlsCfg.ServerName))
+	offered := offeredGQUICVersions(cfg)
+	for _, vn := range offered {
+		c := *cfg
+		c.Versions = []quic.VersionNumber{quic.VersionNumber(vn)}
+		sess, err := dialGQUICVersion(ctx, addr, tlsCfg, &c, localIPs)
+		if err == nil {
+			verbosef("Connected via %s", vn)
+			return sess, vn, nil
+		}
+		if qerr.ToQuicError(err).ErrorCode != qerr.InvalidVersion {
+			return nil, 0, err
+		}
+	}
+
+	// quic-go doesn't tell us the versions advertised by the server
+	advertised, _ := queryServerVersions(addr, config.connectTimeout)
+	return nil, 0, &versionNegotiationError{offered, advertised}
+}
+
+// dialGQUICVersion dials with the single version given in the cfg
+func dialGQUICVersion(ctx context.Context, addr string, tlsCfg *tls.Config,
+	cfg *quic.Config, localIPs []net.IP) (quic.Session, error) {
+
 	done := make(chan struct{})
 	var sess quic.Session
 	var err error
 	go func() {
-		sess, err = quic.DialAddrContext(ctx, addr, tlsCfg, cfg)
+		if bindLocalAddr() {
+			sess, err = dialGQUICFrom(ctx, localIPs, addr, tlsCfg, cfg)
+		} else {
+			sess, err = quic.DialAddrContext(ctx, addr, tlsCfg, cfg)
+		}
+		if err == nil && len(config.pinnedPubKeys) > 0 {
+			// gQUIC doesn't support VerifyPeerCertificate
+			err = checkPinnedPubKey(sess.ConnectionState().PeerCertificates)
+			if err != nil {
+				sess.CloseWithError(quic.ErrorCode(qerr.ProofInvalid), err)
+				sess = nil
+			}
+		}
 		close(done)
 	}()
 
@@ -357,8 +1182,77 @@ func dialWithTimeout(network, addr string, tlsCfg *tls.Config,
 	case <-done:
 		return sess, err
 	case <-ctx.Done():
-		return nil, errors.New("connect timeout")
+		return nil, errConnectTimeout
+	}
+}
+
+// dialH3WithTimeout is the HTTP/3 counterpart of dialWithTimeout
+func dialH3WithTimeout(ctx context.Context, addr string, tlsCfg *tls.Config,
+	cfg *iquic.Config, localIPs []net.IP, addrIndex int, trace *dialTrace) (*iquic.Conn, error) {
+
+	lookupCtx, cancel := context.WithTimeout(ctx, config.connectTimeout)
+	addrs, err := lookupAddrs(lookupCtx, addr)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	trace.addrResolved()
+
+	var failed []string
+	for i := range addrs {
+		a := addrs[(addrIndex+i)%len(addrs)]
+		var conn *iquic.Conn
+		conn, err = dialH3AddrWithTimeout(ctx, a, tlsCfg, cfg, localIPs)
+		if err == nil {
+			reportFailover(failed, a)
+			return conn, nil
+		}
+		if _, ok := err.(*versionNegotiationError); ok || ctx.Err() != nil {
+			return nil, err
+		}
+		verbosef("Failed to connect %s: %s", a, err.Error())
+		failed = append(failed, a)
+	}
+	return nil, err
+}
+
+func dialH3AddrWithTimeout(ctx context.Context, addr string, tlsCfg *tls.Config,
+	cfg *iquic.Config, localIPs []net.IP) (*iquic.Conn, error) {
+
+	dialCtx, cancel := context.WithTimeout(ctx, config.connectTimeout)
+	defer cancel()
+
+	dial := iquic.DialAddr
+	if config.zeroRTT {
+		dial = iquic.DialAddrEarly
+	}
+	verbosef("Connecting to %s, SNI: %s", addr, sniOf(addr, tlsCfg.ServerName))
+	var conn *iquic.Conn
+	var err error
+	if bindLocalAddr() {
+		conn, err = dialH3From(dialCtx, localIPs, addr, tlsCfg, cfg)
+	} else {
+		conn, err = dial(dialCtx, addr, tlsCfg, cfg)
 	}
+	if err != nil {
+		if ctx.Err() == nil && dialCtx.Err() == context.DeadlineExceeded {
+			return nil, errConnectTimeout
+		}
+		var vnErr *iquic.VersionNegotiationError
+		if errors.As(err, &vnErr) {
+			negErr := &versionNegotiationError{}
+			for _, v := range vnErr.Ours {
+				negErr.offered = append(negErr.offered, VersionNumber(v))
+			}
+			for _, v := range vnErr.Theirs {
+				negErr.advertised = append(negErr.advertised, VersionNumber(v))
+			}
+			return nil, negErr
+		}
+		return nil, err
+	}
+	verbosef("Connected via %s", VersionNumber(conn.ConnectionState().Version))
+	return conn, nil
 }
 
 type cancellableBody struct {
@@ -422,19 +1316,87 @@ func createCookieManager() (CookieManager, error) {
 	return cm, err
 }
 
-func createClient(cm CookieManager) (*http.Client, error) {
-	quicConf := &quic.Config{
-		IdleTimeout: config.idleTimeout,
-	}
+func createTLSConfig() *tls.Config {
 	tlsConf := &tls.Config{
 		InsecureSkipVerify: config.insecure,
 		ServerName:         config.sni,
+		KeyLogWriter:       keyLogWriter,
+	}
+	if config.clientCert != nil {
+		tlsConf.Certificates = []tls.Certificate{*config.clientCert}
+	}
+	if config.rootCAs != nil {
+		tlsConf.RootCAs = config.rootCAs
 	}
+	if len(config.pinnedPubKeys) > 0 {
+		tlsConf.VerifyPeerCertificate = verifyPinnedPubKey
+	}
+	tlsConf.MaxVersion = config.tlsMax
+	tlsConf.CipherSuites = config.cipherSuites
+	tlsConf.CurvePreferences = config.curves
+	return tlsConf
+}
+
+func createClient(cm CookieManager) (*http.Client, error) {
+	return createTracedClient(cm, nil)
+}
+
+// createTracedClient creates a client whose dials are reported to the trace
+func createTracedClient(cm CookieManager, trace *dialTrace) (*http.Client, error) {
+	tlsConf := createTLSConfig()
+	// each client binds to its own local address, and connects the resolved
+	// addresses in its own order
+	localIPs := nextLocalIPs()
+	addrIndex := nextRemoteAddrIndex()
+
+	var roundTripper http.RoundTripper
+	if config.http3 {
+		if sessionCache != nil {
+			tlsConf.ClientSessionCache = sessionCache
+		}
+		// -tls-max below 1.3 is for the TLS over TCP, QUIC can't use it
+		if tlsConf.MaxVersion != 0 && tlsConf.MaxVersion < tls.VersionTLS13 {
+			tlsConf.MaxVersion = 0
+		}
 
-	roundTripper := &h2quic.RoundTripper{
-		QuicConfig:      quicConf,
-		TLSClientConfig: tlsConf,
-		Dial:            dialWithTimeout,
+		quicConf := &iquic.Config{
+			MaxIdleTimeout: config.idleTimeout,
+		}
+		config.quicParams.applyTo(quicConf)
+		if config.qlogDir != "" {
+			quicConf.Tracer = qlogTracer(config.qlogDir)
+		}
+		if config.quicVersion != 0 {
+			quicConf.Versions = []iquic.Version{iquic.Version(config.quicVersion)}
+		}
+		roundTripper = &http3.Transport{
+			QUICConfig:      quicConf,
+			TLSClientConfig: tlsConf,
+			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config,
+				cfg *iquic.Config) (*iquic.Conn, error) {
+				return dialH3WithTimeout(ctx, addr, tlsCfg, cfg, localIPs, addrIndex, trace)
+			},
+		}
+	} else {
+		quicConf := &quic.Config{
+			IdleTimeout: config.idleTimeout,
+		}
+		config.quicParams.applyToGQUIC(quicConf)
+		if config.quicVersion != 0 {
+			quicConf.Versions = []quic.VersionNumber{quic.VersionNumber(config.quicVersion)}
+		}
+		roundTripper = &h2quic.RoundTripper{
+			QuicConfig:      quicConf,
+			TLSClientConfig: tlsConf,
+			Dial: func(network, addr string, tlsCfg *tls.Config,
+				cfg *quic.Config) (quic.Session, error) {
+				return dialWithTimeout(network, addr, tlsCfg, cfg, localIPs, addrIndex, trace)
+			},
+		}
+	}
+
+	if config.fallbackTCP {
+		roundTripper = newFallbackRoundTripper(roundTripper, createTCPTransport())
 	}
 
 	hclient := &http.Client{
@@ -451,41 +1413,162 @@ func createClient(cm CookieManager) (*http.Client, error) {
 	return hclient, nil
 }
 
+func createTCPTransport() *http.Transport {
+	tlsConf := createTLSConfig()
+
+	dialer := &net.Dialer{
+		Timeout: config.connectTimeout,
+	}
+	return &http.Transport{
+		DialContext:       dialTCP(dialer),
+		TLSClientConfig:   tlsConf,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   config.idleTimeout,
+	}
+}
+
+// dialTCP makes the dialer respect -connect-to, -4, -6, -hosts-file and
+// -dns-servers, and try the addresses given via -resolve in order
+func dialTCP(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if config.ipv4Only {
+			network = "tcp4"
+		} else if config.ipv6Only {
+			network = "tcp6"
+		}
+		var addrs []string
+		var err error
+		if customResolution() {
+			addrs, err = lookupAddrs(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			var found bool
+			addr = mapConnectTo(addr, config)
+			addrs, found = resolvedAddrsOf(addr)
+			if !found {
+				return dialer.DialContext(ctx, network, addr)
+			}
+		}
+
+		var failed []string
+		for _, a := range addrs {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, a)
+			if err == nil {
+				reportFailover(failed, a)
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			failed = append(failed, a)
+		}
+		return nil, err
+	}
+}
+
+// createTCPClient creates a client which sends request over TLS, with the
+// same options as the QUIC one
+func createTCPClient(cm CookieManager) *http.Client {
+	hclient := &http.Client{
+		Jar:       cm.Jar(),
+		Transport: createTCPTransport(),
+	}
+
+	if config.noRedirect {
+		hclient.CheckRedirect = noRedirect
+	} else {
+		hclient.CheckRedirect = redirectResolved
+	}
+
+	return hclient
+}
+
 func destroyClient(hclient *http.Client) {
-	roundTripper := hclient.Transport.(*h2quic.RoundTripper)
-	roundTripper.Close()
+	switch roundTripper := hclient.Transport.(type) {
+	case *http.Transport:
+		roundTripper.CloseIdleConnections()
+	case io.Closer:
+		// h2quic.RoundTripper, http3.Transport and fallbackRoundTripper are
+		// io.Closer
+		roundTripper.Close()
+	}
+}
+
+// openReqBody opens the body specified via -d or -F, and returns it with its
+// Content-Type
+func openReqBody() (io.ReadCloser, string, error) {
+	if config.data.Provided() {
+		return config.data.Open(config.contentType)
+	}
+	return config.forms.Open()
+}
+
+// reqSpec describes the request to create. The one given in the command line
+// is taken from the config, while the ones in batch mode are read from a file.
+type reqSpec struct {
+	method  string
+	address string
+	// the address may be changed via -resolve option, we need to use the
+	// origin Host instead
+	originHost string
+	header     http.Header
+	// openBody opens the body with its Content-Type, nil means no body
+	openBody func() (io.ReadCloser, string, error)
+}
+
+// configReqSpec returns the request given in the command line
+func configReqSpec() *reqSpec {
+	spec := &reqSpec{
+		method:     config.method,
+		address:    config.address,
+		originHost: config.originHost,
+		header:     config.customHeaders.hdr,
+	}
+	if config.data.Provided() || config.forms.Provided() {
+		spec.openBody = openReqBody
+	}
+	return spec
 }
 
 func createReq(oldReq *http.Request) (*http.Request, context.CancelFunc, error) {
+	return createReqFrom(configReqSpec(), oldReq)
+}
+
+func createReqFrom(spec *reqSpec, oldReq *http.Request) (*http.Request, context.CancelFunc, error) {
 	var err error
 	var body io.ReadCloser
-	if config.data.Provided() || config.forms.Provided() {
-		var ct string
+	contentType := config.contentType
+	if spec.openBody != nil {
 		// need to create separate body reader for each request
-		if config.data.Provided() {
-			body, ct, err = config.data.Open(config.contentType)
-		} else {
-			body, ct, err = config.forms.Open()
-		}
+		body, contentType, err = spec.openBody()
 		if err != nil {
 			return nil, nil, err
 		}
-		config.contentType = ct
 	}
 
 	var req *http.Request
 	if oldReq == nil || body != nil {
-		req, err = http.NewRequest(config.method, config.address, body)
+		req, err = http.NewRequest(spec.method, spec.address, body)
 		if err != nil {
 			return nil, nil, err
 		}
 
+		if spec.openBody != nil {
+			// the body is reopened when the request is sent again, like
+			// falling back to TCP
+			req.GetBody = func() (io.ReadCloser, error) {
+				body, _, err := spec.openBody()
+				return body, err
+			}
+		}
+
 		req.Header.Set("User-Agent", config.userAgent)
-		req.Header.Set("Content-Type", config.contentType)
-		// the config.address may be changed via -resolve option, we need to
-		// use the origin Host instead
-		req.Header.Set("Host", config.originHost)
-		for k, v := range config.customHeaders.hdr {
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Host", spec.originHost)
+		for k, v := range spec.header {
 			req.Header[k] = v
 		}
 		if host := req.Header.Get("Host"); host != "" {
@@ -505,9 +1588,34 @@ func createReq(oldReq *http.Request) (*http.Request, context.CancelFunc, error)
 	return req, cancel, nil
 }
 
+// respOutput describes how the response is written
+type respOutput struct {
+	// write the status line and the headers before the body, like -i
+	headersIncluded bool
+	// write the status line and the headers only, like -I
+	headersOnly bool
+	// write the body to this file instead if not empty
+	filename string
+}
+
+// configRespOutput returns the output given in the command line
+func configRespOutput() respOutput {
+	return respOutput{
+		headersIncluded: config.headersIncluded,
+		headersOnly:     config.headersOnly,
+		filename:        config.outFilename,
+	}
+}
+
 func readResp(req *http.Request, resp *http.Response, out io.Writer, buf []byte) error {
-	headersIncluded := config.headersIncluded
-	headersOnly := config.headersOnly
+	return readRespTo(req, resp, out, configRespOutput(), buf)
+}
+
+func readRespTo(req *http.Request, resp *http.Response, out io.Writer,
+	output respOutput, buf []byte) error {
+
+	headersIncluded := output.headersIncluded
+	headersOnly := output.headersOnly
 	if headersIncluded || headersOnly {
 		// curl's -i/-I also shows response line, let's follow it
 		mustWriteString(out, resp.Proto+" "+resp.Status)
@@ -538,9 +1646,8 @@ func readResp(req *http.Request, resp *http.Response, out io.Writer, buf []byte)
 		mustWrite(out, crlf)
 	}
 
-	outFilename := config.outFilename
-	if outFilename != "" {
-		f, err := openFileToWrite(outFilename)
+	if output.filename != "" {
+		f, err := openFileToWrite(output.filename)
 		if err != nil {
 			return err
 		}
@@ -559,40 +1666,258 @@ func readResp(req *http.Request, resp *http.Response, out io.Writer, buf []byte)
 	_, err := io.CopyBuffer(out, resp.Body, buf)
 	if err != nil {
 		return fmt.Errorf("failed to copy the output from %s: %s",
-			config.address, err.Error())
+			req.URL, err.Error())
 	}
 
 	return nil
 }
 
+func handleResp(cm CookieManager, req *http.Request, resp *http.Response,
+	out io.Writer, wo *writeOutInfo) error {
+
+	if config.dumpCookie != "" {
+		err := cm.Dump(config.dumpCookie)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to dump cookie: "+err.Error())
+		}
+	}
+
+	if wo != nil {
+		wo.gotResp(resp)
+	}
+	err := readResp(req, resp, out, make([]byte, 32*1024))
+	if err != nil || wo == nil {
+		return err
+	}
+	return wo.write(out, config.writeOut)
+}
+
+// normalClient is the client used in normal mode, with the hooks installed
+type normalClient struct {
+	*http.Client
+	wo          *writeOutInfo
+	sessTracker *gquicSessionTracker
+	frt         *fallbackRoundTripper
+	earlyData   *earlyDataTracker
+}
+
+func createNormalClient(cm CookieManager, wo *writeOutInfo) (*normalClient, error) {
+	var trace *dialTrace
+	if wo != nil {
+		trace = &dialTrace{resolved: wo.resolved, gquicConnected: wo.connected}
+	}
+	hclient, err := createTracedClient(cm, trace)
+	if err != nil {
+		return nil, err
+	}
+	nc := &normalClient{Client: hclient, wo: wo}
+	if wo != nil {
+		wo.hookClient(hclient)
+	}
+	if config.showCert || config.exportCert != "" {
+		nc.sessTracker = trackGQUICSession(hclient)
+	}
+	nc.frt, _ = hclient.Transport.(*fallbackRoundTripper)
+	if config.verbose {
+		enableVerbose(hclient)
+	}
+	if config.zeroRTT && config.http3 {
+		nc.earlyData = trackEarlyData(hclient)
+	}
+	return nc, nil
+}
+
 func runInNormalMode(cm CookieManager, out io.Writer) error {
-	hclient, err := createClient(cm)
+	if config.parallel {
+		return runInParallel(cm, out)
+	}
+	if len(config.urls) > 1 {
+		return runWithURLs(cm, out)
+	}
+	// the glob may be expanded to a single URL, like {a} or [1-1]
+	if config.outFilename != "" && len(config.urls) == 1 {
+		config.outFilename = expandOutput(config.outFilename, config.urls[0].values)
+	}
+
+	var wo *writeOutInfo
+	if config.writeOut != "" {
+		wo = newWriteOutInfo()
+	}
+
+	if config.altSvc {
+		served, err := discoverAltSvc(cm, out, wo)
+		if served || err != nil {
+			return err
+		}
+	}
+
+	nc, err := createNormalClient(cm, wo)
 	if err != nil {
 		return err
 	}
-	defer destroyClient(hclient)
+	// the client may be renewed when retrying
+	defer func() { destroyClient(nc.Client) }()
+	return doRequest(cm, nc, out)
+}
 
-	req, cancel, err := createReq(nil)
+// runWithURLs requests the URLs one by one. The client is shared by the URLs
+// with the same SNI, so that the connection to the same authority is reused.
+func runWithURLs(cm CookieManager, out io.Writer) error {
+	var wo *writeOutInfo
+	if config.writeOut != "" {
+		wo = newWriteOutInfo()
+	}
+	clients := map[string]*normalClient{}
+	defer func() {
+		for _, nc := range clients {
+			destroyClient(nc.Client)
+		}
+	}()
+
+	outFilename := config.outFilename
+	defer func() { config.outFilename = outFilename }()
+	failed := 0
+	for i, u := range config.urls {
+		nc, err := useNthURL(cm, i, clients, wo)
+		if err == nil {
+			if outFilename != "" {
+				config.outFilename = expandOutput(outFilename, u.values)
+			}
+			if wo != nil {
+				wo.reset()
+			}
+			err = doRequest(cm, nc, out)
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Failed to request %s: %s\n", u.url, err.Error())
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d URLs failed", failed, len(config.urls))
+	}
+	return nil
+}
+
+// useNthURL makes the i-th URL the target of the requests, and returns the
+// client for it. The client is created on demand and shared by the URLs with
+// the same SNI.
+func useNthURL(cm CookieManager, i int, clients map[string]*normalClient,
+	wo *writeOutInfo) (*normalClient, error) {
+
+	// the first URL is already used, and its HTTPS record is queried
+	if i > 0 {
+		err := useURL(config.urls[i].url)
+		if err == nil && config.httpsRR {
+			err = useHTTPSRecord()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if nc, found := clients[config.sni]; found {
+		return nc, nil
+	}
+	nc, err := createNormalClient(cm, wo)
+	if err != nil {
+		return nil, err
+	}
+	clients[config.sni] = nc
+	return nc, nil
+}
+
+// renew replaces the client with a new one, since the failed connection is
+// cached by the client
+func (nc *normalClient) renew(cm CookieManager) error {
+	fresh, err := createNormalClient(cm, nc.wo)
 	if err != nil {
 		return err
 	}
+	destroyClient(nc.Client)
+	*nc = *fresh
+	return nil
+}
+
+// doRequest sends the request to the config.address and handles the response.
+// The request is retried on the transient failures if -retry is given.
+func doRequest(cm CookieManager, nc *normalClient, out io.Writer) error {
+	rp := newRetryPolicy()
+	for {
+		retry, err := tryRequest(cm, nc, out, rp)
+		if !retry {
+			return err
+		}
+		// -w reports the final attempt
+		if nc.wo != nil {
+			nc.wo.reset()
+		}
+	}
+}
+
+// tryRequest sends the request once. It returns true if the request should be
+// retried.
+func tryRequest(cm CookieManager, nc *normalClient, out io.Writer, rp *retryPolicy) (bool, error) {
+	hclient := nc.Client
+	wo := nc.wo
+	// the body is opened again for each attempt
+	req, cancel, err := createReq(nil)
+	if err != nil {
+		return false, err
+	}
 	if cancel != nil {
 		defer cancel()
 	}
 
+	tracker := nc.earlyData
+	if tracker != nil {
+		req.Method = to0RTTMethod(req.Method)
+	}
+
 	resp, err := hclient.Do(req)
+	if tracker != nil {
+		if errors.Is(err, iquic.Err0RTTRejected) {
+			fmt.Fprintln(os.Stderr, "0-RTT: rejected by the server, resend the request")
+			// resend it once without early data, the rejected connection is
+			// cached by the client
+			config.zeroRTT = false
+			err = nc.renew(cm)
+			return err == nil, err
+		}
+		if err == nil {
+			if tracker.used0RTT() {
+				fmt.Fprintln(os.Stderr, "0-RTT: accepted")
+			} else {
+				fmt.Fprintln(os.Stderr, "0-RTT: not used, no session allowing early data for the server")
+			}
+		}
+	}
+	if rp.wait(resp, err) {
+		if err != nil {
+			err = nc.renew(cm)
+			return err == nil, err
+		}
+		// drain the body so that the stream is done
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return true, nil
+	}
 	if err != nil {
-		return err
+		reportClientCert(err)
+		return false, explainHandshakeError(err)
 	}
 
-	if config.dumpCookie != "" {
-		err = cm.Dump(config.dumpCookie)
+	if nc.frt != nil {
+		fmt.Fprintf(os.Stderr, "Served over %s\n", nc.frt.protocol())
+	}
+	if config.showCert || config.exportCert != "" {
+		err = showCert(os.Stderr, resp, nc.sessTracker)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "failed to dump cookie: "+err.Error())
+			resp.Body.Close()
+			return false, err
 		}
 	}
 
-	return readResp(req, resp, out, make([]byte, 32*1024))
+	return false, handleResp(cm, req, resp, out, wo)
 }
 
 func runInBenchmarkMode(cm CookieManager, out io.Writer) error {
@@ -605,9 +1930,18 @@ func runInBenchmarkMode(cm CookieManager, out io.Writer) error {
 		config.bmConn,
 		config.bmReqPerConn,
 	)
+	if config.bmNewConn > 0 {
+		fmt.Fprintf(out, "  a new connection every %d requests\n", config.bmNewConn)
+	}
+	fmt.Fprintf(out, "  QUIC config: %s\n",
+		config.quicParams.describe(config.http3, config.idleTimeout))
+	if len(config.localIPs) > 1 {
+		fmt.Fprintf(out, "  connections spread across %d local addresses\n",
+			len(config.localIPs))
+	}
 
 	conns := make([]*http.Client, config.bmConn)
-	for i := 0; i < config.bmConn; i++ {
+	for i := 0; config.bmNewConn == 0 && i < config.bmConn; i++ {
 		hclient, err := createClient(cm)
 		if err != nil {
 			return err
@@ -629,7 +1963,7 @@ func runInBenchmarkMode(cm CookieManager, out io.Writer) error {
 	wg.Add(config.bmConn)
 	now := time.Now()
 	for i := 0; i < config.bmConn; i++ {
-		go runReqsInParallel(conns[i], &stats[i], &wg, cancelled)
+		go runReqsInParallel(conns[i], cm, &stats[i], &wg, cancelled)
 	}
 	wg.Wait()
 
@@ -644,9 +1978,57 @@ func run(out io.Writer) error {
 		return err
 	}
 
+	sessionCache = nil
+	if config.sessionFile != "" {
+		sessionCache, err = loadSessionCache(config.sessionFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := sessionCache.Save(config.sessionFile)
+			if err != nil {
+				warn("failed to save TLS sessions: %s", err.Error())
+			}
+		}()
+	}
+
+	keyLogWriter = nil
+	clientCertReported = 0
+	localAddrIndex = 0
+	remoteAddrIndex = 0
+	if fn := keyLogFile(); fn != "" {
+		f, err := openKeyLogFile(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		keyLogWriter = &syncWriter{w: f}
+	}
+
+	if config.qlogDir != "" {
+		err := os.MkdirAll(config.qlogDir, 0755)
+		if err != nil {
+			return err
+		}
+		defer waitQlogFiles()
+	}
+
+	if config.httpsRR {
+		err := useHTTPSRecord()
+		if err != nil {
+			return err
+		}
+	}
+
 	if config.bmEnabled {
 		return runInBenchmarkMode(cm, out)
 	}
+	if config.probe {
+		return runInProbeMode(cm, out)
+	}
+	if config.requestsFile != "" {
+		return runInBatchMode(cm, out)
+	}
 	return runInNormalMode(cm, out)
 }
 
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	iquic "github.com/quic-go/quic-go"
+)
+
+// sizeValue is a size in bytes, which can be given like "512KB" or "6MB"
+type sizeValue uint64
+
+var sizeUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+func (sv *sizeValue) String() string {
+	return formatSize(uint64(*sv))
+}
+
+func (sv *sizeValue) Set(value string) error {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	unit := uint64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = s[:len(s)-len(u.suffix)]
+			unit = u.size
+			break
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size: %s", value)
+	}
+	*sv = sizeValue(n * unit)
+	return nil
+}
+
+func formatSize(n uint64) string {
+	for _, u := range sizeUnits[:3] {
+		if n >= u.size && n%u.size == 0 {
+			return strconv.FormatUint(n/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+// quicParams are the transport parameters which can be tuned via -quic-*.
+// The zero value means the default of quic-go.
+type quicParams struct {
+	initialStreamWindow sizeValue
+	streamWindow        sizeValue
+	initialConnWindow   sizeValue
+	connWindow          sizeValue
+	maxStreams          int
+	maxUniStreams       int
+	keepAlive           time.Duration
+	handshakeTimeout    time.Duration
+	initialPacketSize   int
+	disablePMTUD        bool
+}
+
+// the defaults of quic-go, which are not exported
+var (
+	defaultQUICParams = quicParams{
+		initialStreamWindow: 512 << 10,
+		streamWindow:        6 << 20,
+		initialConnWindow:   768 << 10,
+		connWindow:          15 << 20,
+		maxStreams:          100,
+		maxUniStreams:       100,
+		handshakeTimeout:    5 * time.Second,
+		initialPacketSize:   1280,
+	}
+	defaultGQUICParams = quicParams{
+		streamWindow:     6 << 20,
+		connWindow:       15 << 20,
+		maxStreams:       100,
+		maxUniStreams:    100,
+		handshakeTimeout: 10 * time.Second,
+	}
+	defaultIdleTimeout = 30 * time.Second
+)
+
+// the maximum packet size supported by quic-go
+const maxInitialPacketSize = 1452
+
+func (p *quicParams) check() error {
+	if p.maxStreams < 0 {
+		return fmt.Errorf("-quic-max-streams should not be negative, got %d", p.maxStreams)
+	}
+	if p.maxUniStreams < 0 {
+		return fmt.Errorf("-quic-max-uni-streams should not be negative, got %d",
+			p.maxUniStreams)
+	}
+	if p.keepAlive < 0 {
+		return fmt.Errorf("-quic-keep-alive should not be negative, got %v", p.keepAlive)
+	}
+	if p.handshakeTimeout < 0 {
+		return fmt.Errorf("-quic-handshake-timeout should not be negative, got %v",
+			p.handshakeTimeout)
+	}
+	if p.initialPacketSize != 0 && (p.initialPacketSize < minInitialPacketSize ||
+		p.initialPacketSize > maxInitialPacketSize) {
+
+		return fmt.Errorf("-quic-initial-packet-size should be between %d and %d, got %d",
+			minInitialPacketSize, maxInitialPacketSize, p.initialPacketSize)
+	}
+
+	if p.streamWindow != 0 && p.initialStreamWindow > p.streamWindow {
+		return fmt.Errorf("-quic-initial-stream-window %s is larger than -quic-stream-window %s",
+			&p.initialStreamWindow, &p.streamWindow)
+	}
+	if p.connWindow != 0 && p.initialConnWindow > p.connWindow {
+		return fmt.Errorf("-quic-initial-conn-window %s is larger than -quic-conn-window %s",
+			&p.initialConnWindow, &p.connWindow)
+	}
+	return nil
+}
+
+// onlyForIETFQUIC says if any parameter not supported by gQUIC is given
+func (p *quicParams) onlyForIETFQUIC() bool {
+	return p.initialStreamWindow != 0 || p.initialConnWindow != 0 ||
+		p.initialPacketSize != 0 || p.disablePMTUD
+}
+
+// effective returns the parameters used, with the defaults filled
+func (p *quicParams) effective(http3 bool) quicParams {
+	eff := *p
+	def := defaultGQUICParams
+	if http3 {
+		def = defaultQUICParams
+	}
+	if eff.streamWindow == 0 {
+		eff.streamWindow = def.streamWindow
+	}
+	if eff.initialStreamWindow == 0 {
+		eff.initialStreamWindow = def.initialStreamWindow
+	}
+	if eff.connWindow == 0 {
+		eff.connWindow = def.connWindow
+	}
+	if eff.initialConnWindow == 0 {
+		eff.initialConnWindow = def.initialConnWindow
+	}
+	// the initial window can't be larger than the maximum one
+	if eff.initialStreamWindow > eff.streamWindow {
+		eff.initialStreamWindow = eff.streamWindow
+	}
+	if eff.initialConnWindow > eff.connWindow {
+		eff.initialConnWindow = eff.connWindow
+	}
+	if eff.maxStreams == 0 {
+		eff.maxStreams = def.maxStreams
+	}
+	if eff.maxUniStreams == 0 {
+		eff.maxUniStreams = def.maxUniStreams
+	}
+	if eff.handshakeTimeout == 0 {
+		eff.handshakeTimeout = def.handshakeTimeout
+	}
+	if eff.initialPacketSize == 0 {
+		eff.initialPacketSize = def.initialPacketSize
+	}
+	return eff
+}
+
+func (p *quicParams) applyTo(cfg *iquic.Config) {
+	eff := p.effective(true)
+	// only the maximum window may be given, use the effective initial ones
+	// so that they are not larger than it
+	cfg.InitialStreamReceiveWindow = uint64(eff.initialStreamWindow)
+	cfg.MaxStreamReceiveWindow = uint64(p.streamWindow)
+	cfg.InitialConnectionReceiveWindow = uint64(eff.initialConnWindow)
+	cfg.MaxConnectionReceiveWindow = uint64(p.connWindow)
+	cfg.MaxIncomingStreams = int64(p.maxStreams)
+	cfg.MaxIncomingUniStreams = int64(p.maxUniStreams)
+	cfg.KeepAlivePeriod = p.keepAlive
+	cfg.HandshakeIdleTimeout = p.handshakeTimeout
+	cfg.InitialPacketSize = uint16(p.initialPacketSize)
+	cfg.DisablePathMTUDiscovery = p.disablePMTUD
+}
+
+func (p *quicParams) applyToGQUIC(cfg *quic.Config) {
+	cfg.MaxReceiveStreamFlowControlWindow = uint64(p.streamWindow)
+	cfg.MaxReceiveConnectionFlowControlWindow = uint64(p.connWindow)
+	cfg.MaxIncomingStreams = p.maxStreams
+	cfg.MaxIncomingUniStreams = p.maxUniStreams
+	// the interval of the keep-alive is not configurable in gQUIC, it is half
+	// of the idle timeout
+	cfg.KeepAlive = p.keepAlive > 0
+	cfg.HandshakeTimeout = p.handshakeTimeout
+}
+
+// describe returns the effective parameters, which is printed at the start
+// of the benchmark
+func (p *quicParams) describe(http3 bool, idleTimeout time.Duration) string {
+	eff := p.effective(http3)
+	if idleTimeout == 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	keepAlive := "off"
+	if eff.keepAlive > 0 {
+		keepAlive = eff.keepAlive.String()
+		if !http3 {
+			keepAlive = "on"
+		}
+	}
+
+	var b strings.Builder
+	if http3 {
+		fmt.Fprintf(&b, "stream window %s/%s, connection window %s/%s, ",
+			&eff.initialStreamWindow, &eff.streamWindow,
+			&eff.initialConnWindow, &eff.connWindow)
+	} else {
+		fmt.Fprintf(&b, "stream window %s, connection window %s, ",
+			&eff.streamWindow, &eff.connWindow)
+	}
+	fmt.Fprintf(&b, "max streams %d, max uni streams %d, keep-alive %s, ",
+		eff.maxStreams, eff.maxUniStreams, keepAlive)
+	fmt.Fprintf(&b, "handshake timeout %v, idle timeout %v",
+		eff.handshakeTimeout, idleTimeout)
+	if http3 {
+		pmtud := "on"
+		if eff.disablePMTUD {
+			pmtud = "off"
+		}
+		fmt.Fprintf(&b, ", initial packet size %d, PMTUD %s", eff.initialPacketSize, pmtud)
+	}
+	return b.String()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	iquic "github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizeValue(t *testing.T) {
+	var sv sizeValue
+	for s, expected := range map[string]uint64{
+		"1024":  1024,
+		"512KB": 512 << 10,
+		"6mb":   6 << 20,
+		"1G":    1 << 30,
+		"100B":  100,
+	} {
+		assert.Nil(t, sv.Set(s))
+		assert.Equal(t, sizeValue(expected), sv)
+	}
+	assert.Equal(t, "invalid size: 1.5MB", sv.Set("1.5MB").Error())
+	assert.Equal(t, "invalid size: -1", sv.Set("-1").Error())
+
+	assert.Equal(t, "1000", formatSize(1000))
+	assert.Equal(t, "768KB", formatSize(768<<10))
+	assert.Equal(t, "1536KB", formatSize(1536<<10))
+	assert.Equal(t, "15MB", formatSize(15<<20))
+	assert.Equal(t, "2GB", formatSize(2<<30))
+}
+
+func TestQUICParams(t *testing.T) {
+	p := quicParams{initialStreamWindow: 2 << 20, streamWindow: 1 << 20}
+	assert.Equal(t, "-quic-initial-stream-window 2MB is larger than -quic-stream-window 1MB",
+		p.check().Error())
+	p = quicParams{initialPacketSize: 1000}
+	assert.Equal(t, "-quic-initial-packet-size should be between 1200 and 1452, got 1000",
+		p.check().Error())
+	p = quicParams{maxStreams: -1}
+	assert.Equal(t, "-quic-max-streams should not be negative, got -1", p.check().Error())
+
+	// the default initial window is larger than the maximum one given
+	p = quicParams{streamWindow: 256 << 10, keepAlive: time.Second}
+	assert.Nil(t, p.check())
+	cfg := &iquic.Config{}
+	p.applyTo(cfg)
+	assert.Equal(t, uint64(256<<10), cfg.InitialStreamReceiveWindow)
+	assert.Equal(t, uint64(256<<10), cfg.MaxStreamReceiveWindow)
+	assert.Equal(t, uint64(768<<10), cfg.InitialConnectionReceiveWindow)
+	assert.Equal(t, time.Second, cfg.KeepAlivePeriod)
+
+	assert.Equal(t, "stream window 256KB/256KB, connection window 768KB/15MB, "+
+		"max streams 100, max uni streams 100, keep-alive 1s, handshake timeout 5s, "+
+		"idle timeout 30s, initial packet size 1280, PMTUD on",
+		p.describe(true, 0))
+	assert.Equal(t, "stream window 256KB, connection window 15MB, "+
+		"max streams 100, max uni streams 100, keep-alive on, handshake timeout 10s, "+
+		"idle timeout 1m0s",
+		p.describe(false, time.Minute))
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type resolveValue struct {
@@ -49,35 +52,274 @@ func (rv *resolveValue) Set(value string) error {
 		return fmt.Errorf("invalid resolve: [%s]", value)
 	}
 	src := res[0] + ":" + res[1]
-	var dst string
-	_, _, err := net.SplitHostPort(res[2])
-	if err != nil {
-		addrErr := err.(*net.AddrError)
-		if addrErr.Err != missingPort {
-			return fmt.Errorf("invalid resolve: [%s]", value)
+	// multiple addresses separated by ',' are tried in order
+	dsts := strings.Split(res[2], ",")
+	for i, dst := range dsts {
+		_, _, err := net.SplitHostPort(dst)
+		if err != nil {
+			addrErr := err.(*net.AddrError)
+			if addrErr.Err != missingPort || dst == "" {
+				return fmt.Errorf("invalid resolve: [%s]", value)
+			}
+			dsts[i] = dst + ":" + res[1]
 		}
-		dst = res[2] + ":" + res[1]
-	} else {
-		dst = res[2]
 	}
+	dst := strings.Join(dsts, ",")
 	// prepend so the later one wins
 	rv.addrs = append([][]string{[]string{src, dst}}, rv.addrs...)
 	return nil
 }
 
+// connectToRule is a HOST1:PORT1:HOST2:PORT2 pair given via -connect-to, the
+// empty fields match any host or port, or keep the original one
+type connectToRule struct {
+	host   string
+	port   string
+	toHost string
+	toPort string
+}
+
+type connectToValue struct {
+	rules []connectToRule
+}
+
+func (cv *connectToValue) String() string {
+	rules := make([]string, len(cv.rules))
+	for i, r := range cv.rules {
+		rules[i] = strings.Join([]string{bracketIPv6(r.host), r.port,
+			bracketIPv6(r.toHost), r.toPort}, ":")
+	}
+	return strings.Join(rules, " ")
+}
+
+func bracketIPv6(host string) string {
+	if strings.IndexByte(host, ':') != -1 {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// splitConnectTo splits the value into host:port:host:port, the IPv6 address
+// should be enclosed in brackets
+func splitConnectTo(value string) ([]string, bool) {
+	var fields []string
+	for i := 0; i < 4; i++ {
+		var field string
+		if strings.HasPrefix(value, "[") {
+			right := strings.IndexByte(value, ']')
+			if right == -1 {
+				return nil, false
+			}
+			field = value[1:right]
+			value = value[right+1:]
+			if value != "" && value[0] != ':' {
+				return nil, false
+			}
+		} else {
+			end := strings.IndexByte(value, ':')
+			if end == -1 {
+				end = len(value)
+			}
+			field = value[:end]
+			value = value[end:]
+		}
+		fields = append(fields, field)
+		if i < 3 {
+			if value == "" {
+				return nil, false
+			}
+			// skip ':'
+			value = value[1:]
+		}
+	}
+	return fields, value == ""
+}
+
+func (cv *connectToValue) Set(value string) error {
+	fields, ok := splitConnectTo(value)
+	if !ok {
+		return fmt.Errorf("invalid connect-to: [%s]", value)
+	}
+	for _, port := range []string{fields[1], fields[3]} {
+		if port == "" {
+			continue
+		}
+		if i, err := strconv.Atoi(port); err != nil || !(0 < i && i < 65536) {
+			return fmt.Errorf("invalid connect-to: [%s]", value)
+		}
+	}
+	// like curl, the first matched one is used
+	cv.rules = append(cv.rules, connectToRule{
+		host:   fields[0],
+		port:   fields[1],
+		toHost: fields[2],
+		toPort: fields[3],
+	})
+	return nil
+}
+
+// mapConnectTo returns the address to connect instead of the addr, according
+// to -connect-to
+func mapConnectTo(addr string, config *quickConfig) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	for _, r := range config.connectTo.rules {
+		if (r.host != "" && r.host != host) || (r.port != "" && r.port != port) {
+			continue
+		}
+		if r.toHost != "" {
+			host = r.toHost
+		}
+		if r.toPort != "" {
+			port = r.toPort
+		}
+		newAddr := net.JoinHostPort(host, port)
+		if newAddr != addr {
+			verbosef("Connect to %s instead of %s", newAddr, addr)
+		}
+		return newAddr
+	}
+	return addr
+}
+
 func resolveAddr(host string, config *quickConfig) string {
+	config.originHost = originOf(host)
+	return resolvedAddr(host, config)
+}
+
+// originOf returns the host sent in the Host header, without the default port
+func originOf(host string) string {
 	if h, p, _ := net.SplitHostPort(host); p == "443" {
-		config.originHost = h
-	} else {
-		config.originHost = host
+		return h
+	}
+	return host
+}
+
+// resolvedAddr returns the address to connect for the host, which may be given
+// via -resolve. The rest of the addresses given are found by resolvedAddrsOf,
+// so the config is not changed.
+func resolvedAddr(host string, config *quickConfig) string {
+	if addr, found := lookupResolve(host, config); found {
+		verbosef("Resolve %s to %s", host, addr)
+		return strings.Split(addr, ",")[0]
+	}
+	return host
+}
+
+// firstResolvedAddr returns the first of the addresses given via -resolve. It
+// is used in the URL, the rest are tried when failed to connect it.
+func firstResolvedAddr(addr string, config *quickConfig) string {
+	addrs := strings.Split(addr, ",")
+	if len(addrs) > 1 {
+		if config.resolvedAddrs == nil {
+			config.resolvedAddrs = map[string][]string{}
+		}
+		config.resolvedAddrs[addrs[0]] = addrs
 	}
+	return addrs[0]
+}
+
+// lookupResolve finds the address provided via -resolve for the host:port pair
+func lookupResolve(host string, config *quickConfig) (string, bool) {
 	for _, pair := range config.revolver.addrs {
 		if pair[0] == host {
-			return pair[1]
+			return pair[1], true
 		}
 	}
+	return "", false
+}
 
-	return host
+// remoteAddrIndex is used to spread the clients across the resolved addresses
+var remoteAddrIndex uint32
+
+// nextRemoteAddrIndex returns the index of the address which the next client
+// should try first, in round-robin
+func nextRemoteAddrIndex() int {
+	return int(atomic.AddUint32(&remoteAddrIndex, 1) - 1)
+}
+
+// ipNetwork returns the network used to look up the addresses, according to
+// -4 and -6
+func ipNetwork() string {
+	if config.ipv4Only {
+		return "ip4"
+	}
+	if config.ipv6Only {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// resolvedAddrsOf returns the addresses given via -resolve for the addr
+func resolvedAddrsOf(addr string) ([]string, bool) {
+	if addrs, found := config.resolvedAddrs[addr]; found {
+		return addrs, true
+	}
+	// the first of the addresses given via -resolve is used in the URL
+	for _, pair := range config.revolver.addrs {
+		addrs := strings.Split(pair[1], ",")
+		if len(addrs) > 1 && addrs[0] == addr {
+			return addrs, true
+		}
+	}
+	// the address may be changed via -connect-to
+	if target, found := lookupResolve(addr, config); found {
+		return strings.Split(target, ","), true
+	}
+	return nil, false
+}
+
+// lookupAddrs returns the addresses to connect for the addr in the order to try
+// them, which are mapped via -connect-to, given via -resolve or resolved from
+// the host
+func lookupAddrs(ctx context.Context, addr string) ([]string, error) {
+	addr = mapConnectTo(addr, config)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, found := resolvedAddrsOf(addr)
+	if !found {
+		if net.ParseIP(host) != nil {
+			addrs = []string{addr}
+		} else {
+			ips, err := lookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			// like net.ResolveUDPAddr, prefer IPv4
+			sort.SliceStable(ips, func(i, j int) bool {
+				return ips[i].To4() != nil && ips[j].To4() == nil
+			})
+			for _, ip := range ips {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+			}
+			verbosef("Resolve %s to %s", host, strings.Join(addrs, ","))
+		}
+	}
+
+	if !config.ipv4Only && !config.ipv6Only {
+		return addrs, nil
+	}
+	var res []string
+	for _, a := range addrs {
+		h, _, _ := net.SplitHostPort(a)
+		ip := net.ParseIP(h)
+		if ip == nil || (ip.To4() != nil) == config.ipv4Only {
+			res = append(res, a)
+		}
+	}
+	if len(res) == 0 {
+		family := "IPv4"
+		if config.ipv6Only {
+			family = "IPv6"
+		}
+		return nil, fmt.Errorf("no %s address for %s", family, host)
+	}
+	return res, nil
 }
 
 // copied from Go's source code
@@ -94,21 +336,48 @@ func refererForURL(lastReq, newReq *url.URL) string {
 }
 
 func redirectResolved(req *http.Request, via []*http.Request) error {
+	origin, err := followResolved(req, via, config.originHost)
+	if err != nil {
+		return err
+	}
+	config.originHost = origin
+	return nil
+}
+
+// redirectResolvedFrom returns the CheckRedirect like redirectResolved, which
+// keeps the origin of its own instead of the config.originHost. It is used by
+// the transfers in parallel mode, which can't share the config.
+func redirectResolvedFrom(origin string) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		newOrigin, err := followResolved(req, via, origin)
+		if err != nil {
+			return err
+		}
+		origin = newOrigin
+		return nil
+	}
+}
+
+// followResolved sends the redirected request to the address given via
+// -resolve. The originHost is the one of the last request, and the one of the
+// redirected request is returned.
+func followResolved(req *http.Request, via []*http.Request, originHost string) (string, error) {
 	// copy from client.go#defaultCheckRedirect
 	if len(via) >= 10 {
-		return errors.New("stopped after 10 redirects")
+		return "", errors.New("stopped after 10 redirects")
 	}
 
+	verbosef("Redirect to %s", req.URL)
+
 	host := req.URL.Host
 	if req.URL.Port() == "" {
 		scheme := req.URL.Scheme
 		if scheme != "" && scheme != "https" {
-			return fmt.Errorf("unsupported scheme %s in redirect", scheme)
+			return "", fmt.Errorf("unsupported scheme %s in redirect", scheme)
 		}
 		host += ":443"
 	}
-	originHost := config.originHost
-	newHost := resolveAddr(host, config)
+	newHost := resolvedAddr(host, config)
 	if newHost != host {
 		preReqURL := via[len(via)-1].URL
 		preReqURL.Host = originHost
@@ -118,5 +387,5 @@ func redirectResolved(req *http.Request, via []*http.Request) error {
 		req.URL.Host = newHost
 		req.Host = newHost
 	}
-	return nil
+	return originOf(host), nil
 }
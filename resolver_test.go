@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -49,3 +50,66 @@ func TestResolve(t *testing.T) {
 		"-resolve", "test.com:8443:127.0.0.1", "test.com:8443"},
 		"https://127.0.0.1:8443")
 }
+
+func TestResolveMultipleAddrs(t *testing.T) {
+	defer resetArgs()
+	assert.NotNil(t, config.revolver.Set("test.com:443:127.0.0.1,"))
+	config.revolver.Set("test.com:443:127.0.0.2,[::1]:8443,127.0.0.1")
+	assert.Equal(t, "test.com:443:127.0.0.2:443,[::1]:8443,127.0.0.1:443",
+		config.revolver.String())
+
+	assert.Equal(t, "127.0.0.2:443", resolveAddr("test.com:443", config))
+	// the rest are tried when failed to connect the first one
+	addrs, err := lookupAddrs(context.Background(), "127.0.0.2:443")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.2:443", "[::1]:8443", "127.0.0.1:443"}, addrs)
+	assert.Nil(t, config.resolvedAddrs)
+}
+
+func TestLookupAddrs(t *testing.T) {
+	defer resetArgs()
+	config.resolvedAddrs = map[string][]string{
+		"127.0.0.2:443": {"127.0.0.2:443", "[::1]:8443", "127.0.0.1:443"},
+	}
+	ctx := context.Background()
+	addrs, err := lookupAddrs(ctx, "127.0.0.2:443")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.2:443", "[::1]:8443", "127.0.0.1:443"}, addrs)
+
+	config.ipv6Only = true
+	addrs, err = lookupAddrs(ctx, "127.0.0.2:443")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"[::1]:8443"}, addrs)
+	_, err = lookupAddrs(ctx, "127.0.0.1:443")
+	assert.Equal(t, "no IPv6 address for 127.0.0.1", err.Error())
+
+	config.ipv6Only = false
+	config.ipv4Only = true
+	addrs, err = lookupAddrs(ctx, "127.0.0.2:443")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.2:443", "127.0.0.1:443"}, addrs)
+	addrs, err = lookupAddrs(ctx, "localhost:443")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1:443"}, addrs)
+}
+
+func TestConnectTo(t *testing.T) {
+	defer resetArgs()
+	assert.NotNil(t, config.connectTo.Set("test.com:443:127.0.0.1"))
+	assert.NotNil(t, config.connectTo.Set("test.com:x::"))
+	assert.NotNil(t, config.connectTo.Set("test.com:443::0"))
+	assert.NotNil(t, config.connectTo.Set("[::1:443::"))
+	assert.NotNil(t, config.connectTo.Set("test.com:443:::"))
+	config.connectTo.Set("test.com:443:canary.test.com:")
+	config.connectTo.Set(":8443:[::1]:443")
+	config.connectTo.Set(":::9443")
+	assert.Equal(t, "test.com:443:canary.test.com: :8443:[::1]:443 :::9443",
+		config.connectTo.String())
+
+	assert.Equal(t, "canary.test.com:443", mapConnectTo("test.com:443", config))
+	assert.Equal(t, "[::1]:443", mapConnectTo("test.com:8443", config))
+	assert.Equal(t, "www.test.com:9443", mapConnectTo("www.test.com:443", config))
+
+	config.connectTo = connectToValue{}
+	assert.Equal(t, "www.test.com:443", mapConnectTo("www.test.com:443", config))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/qerr"
+	iquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// the delay before the retry doubles until this limit, like curl
+const maxRetryDelay = 10 * time.Minute
+
+// retryPolicy decides whether the failed request is retried and how long to
+// wait before it, according to -retry and the related options
+type retryPolicy struct {
+	start   time.Time
+	retried int
+}
+
+func newRetryPolicy() *retryPolicy {
+	return &retryPolicy{start: time.Now()}
+}
+
+// retryableStatus reports whether the response with the status is likely to
+// be different next time
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isTransientError reports whether the error is caused by the timeout or the
+// reset of the connection or the stream, which may not happen next time
+func isTransientError(err error) bool {
+	if errors.Is(err, errConnectTimeout) {
+		return true
+	}
+	// the idle timeout and the handshake timeout of both QUIC stacks, and the
+	// timeout of -max-time
+	var timeoutErr interface{ Timeout() bool }
+	if errors.As(err, &timeoutErr) && timeoutErr.Timeout() {
+		return true
+	}
+
+	var gquicErr *qerr.QuicError
+	if errors.As(err, &gquicErr) {
+		switch gquicErr.ErrorCode {
+		case qerr.PublicReset, qerr.PeerGoingAway:
+			return true
+		}
+	}
+	var gquicStreamErr quic.StreamError
+	if errors.As(err, &gquicStreamErr) && gquicStreamErr.Canceled() {
+		return true
+	}
+
+	var resetErr *iquic.StatelessResetError
+	if errors.As(err, &resetErr) {
+		return true
+	}
+	var streamErr *iquic.StreamError
+	if errors.As(err, &streamErr) && streamErr.Remote {
+		return true
+	}
+	var h3Err *http3.Error
+	if errors.As(err, &h3Err) && h3Err.Remote &&
+		h3Err.ErrorCode == http3.ErrCodeRequestRejected {
+
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses the value of Retry-After, which is either the delay in
+// seconds or a date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	delay := t.Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+// backoff returns the delay before the next retry if the server doesn't say
+// it or -retry-delay is given
+func (rp *retryPolicy) backoff() time.Duration {
+	if config.retryDelay > 0 {
+		return config.retryDelay
+	}
+	if rp.retried >= 10 {
+		return maxRetryDelay
+	}
+	delay := time.Second << uint(rp.retried)
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// wait reports whether the request should be retried after the resp or err.
+// If so, it waits for the delay before returning.
+func (rp *retryPolicy) wait(resp *http.Response, err error) bool {
+	if rp.retried >= config.retry {
+		return false
+	}
+
+	var reason string
+	var delay time.Duration
+	var delayGiven bool
+	if err != nil {
+		if !config.retryAllErrors && !isTransientError(err) {
+			return false
+		}
+		reason = err.Error()
+	} else {
+		if !retryableStatus(resp.StatusCode) &&
+			!(config.retryAllErrors && resp.StatusCode >= 400) {
+
+			return false
+		}
+		reason = "HTTP " + resp.Status
+		// like curl, -retry-delay takes precedence over Retry-After
+		if config.retryDelay == 0 {
+			delay, delayGiven = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+	}
+	if !delayGiven {
+		delay = rp.backoff()
+	}
+	if config.retryMaxTime > 0 && time.Since(rp.start)+delay > config.retryMaxTime {
+		return false
+	}
+
+	rp.retried++
+	fmt.Fprintf(os.Stderr, "Retry: %s, will retry in %v, %d retries left\n",
+		reason, delay, config.retry-rp.retried)
+	time.Sleep(delay)
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/qerr"
+	iquic "github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransientError(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://test.com", Err: err}
+	}
+	assert.True(t, isTransientError(wrap(errConnectTimeout)))
+	assert.True(t, isTransientError(wrap(&iquic.IdleTimeoutError{})))
+	assert.True(t, isTransientError(wrap(&iquic.HandshakeTimeoutError{})))
+	assert.True(t, isTransientError(wrap(&iquic.StreamError{Remote: true})))
+	assert.True(t, isTransientError(wrap(&iquic.StatelessResetError{})))
+	assert.True(t, isTransientError(wrap(qerr.Error(qerr.NetworkIdleTimeout, "idle"))))
+	assert.True(t, isTransientError(wrap(qerr.Error(qerr.PublicReset, "reset"))))
+
+	assert.False(t, isTransientError(wrap(&iquic.StreamError{Remote: false})))
+	assert.False(t, isTransientError(wrap(qerr.Error(qerr.InvalidVersion, "version"))))
+	assert.False(t, isTransientError(wrap(errors.New("x509: certificate signed by unknown authority"))))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	delay, ok := parseRetryAfter("3", now)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, delay)
+
+	delay, ok = parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, delay)
+
+	delay, ok = parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), delay)
+
+	for _, v := range []string{"", "-1", "soon"} {
+		_, ok = parseRetryAfter(v, now)
+		assert.False(t, ok, v)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer resetArgs()
+
+	rp := newRetryPolicy()
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		rp.retried = i
+		assert.Equal(t, expected, rp.backoff())
+	}
+	rp.retried = 20
+	assert.Equal(t, maxRetryDelay, rp.backoff())
+
+	config.retryDelay = 100 * time.Millisecond
+	assert.Equal(t, 100*time.Millisecond, rp.backoff())
+}
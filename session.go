@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	iquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// sessionCache is the TLS session cache shared by all clients, nil if
+// -session-file is not specified
+var sessionCache *fileSessionCache
+
+// fileSessionCache is a tls.ClientSessionCache which can be persisted to file.
+// Only the latest session of each server is kept.
+type fileSessionCache struct {
+	lock     sync.Mutex
+	sessions map[string]*tls.ClientSessionState
+}
+
+func newFileSessionCache() *fileSessionCache {
+	return &fileSessionCache{
+		sessions: map[string]*tls.ClientSessionState{},
+	}
+}
+
+func (c *fileSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cs, found := c.sessions[key]
+	return cs, found
+}
+
+func (c *fileSessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cs == nil {
+		delete(c.sessions, key)
+		return
+	}
+	c.sessions[key] = cs
+}
+
+/*
+Each line of the session file is a TLS session, with the fields separated by tab:
+
+key - The key of the session cache, usually it is the server name.
+ticket - The session ticket, encoded in base64.
+state - The session state, encoded in base64.
+*/
+func loadSessionCache(fn string) (*fileSessionCache, error) {
+	c := newFileSessionCache()
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s := scanner.Text()
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(s, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid session(%s): wrong number of fields", s)
+		}
+		ticket, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid session(%s): %s", s, err.Error())
+		}
+		data, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid session(%s): %s", s, err.Error())
+		}
+		state, err := tls.ParseSessionState(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session(%s): %s", s, err.Error())
+		}
+		cs, err := tls.NewResumptionState(ticket, state)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session(%s): %s", s, err.Error())
+		}
+		c.sessions[fields[0]] = cs
+	}
+	return c, scanner.Err()
+}
+
+func (c *fileSessionCache) Save(fn string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	f, err := openFileToWrite(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := make([]string, 0, len(c.sessions))
+	for key := range c.sessions {
+		keys = append(keys, key)
+	}
+	// make the output reproducible
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ticket, state, err := c.sessions[key].ResumptionState()
+		if err != nil {
+			return err
+		}
+		data, err := state.Bytes()
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, strings.Join([]string{
+			key,
+			base64.StdEncoding.EncodeToString(ticket),
+			base64.StdEncoding.EncodeToString(data),
+		}, "\t")+"\n")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// earlyDataTracker records the connection dialed by the client, so that we
+// can know whether the early data is accepted by the server
+type earlyDataTracker struct {
+	lock sync.Mutex
+	conn *iquic.Conn
+}
+
+func trackEarlyData(hclient *http.Client) *earlyDataTracker {
+	tracker := &earlyDataTracker{}
+
+	rt := hclient.Transport
+	// the transport is wrapped with -v
+	if vrt, ok := rt.(*verboseRoundTripper); ok {
+		rt = vrt.rt
+	}
+	if h3rt, ok := rt.(*http3.Transport); ok {
+		dial := h3rt.Dial
+		h3rt.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config,
+			cfg *iquic.Config) (*iquic.Conn, error) {
+
+			conn, err := dial(ctx, addr, tlsCfg, cfg)
+			if err == nil {
+				tracker.lock.Lock()
+				tracker.conn = conn
+				tracker.lock.Unlock()
+			}
+			return conn, err
+		}
+	}
+	return tracker
+}
+
+// used0RTT says if the request is sent as early data and accepted
+func (t *earlyDataTracker) used0RTT() bool {
+	t.lock.Lock()
+	conn := t.conn
+	t.lock.Unlock()
+
+	if conn == nil {
+		return false
+	}
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		return false
+	}
+	return conn.ConnectionState().Used0RTT
+}
+
+// to0RTTMethod returns the method which tells the HTTP/3 client to send the
+// request as early data
+func to0RTTMethod(method string) string {
+	switch method {
+	case http.MethodGet:
+		return http3.MethodGet0RTT
+	case http.MethodHead:
+		return http3.MethodHead0RTT
+	}
+	return method
+}
+
+// from0RTTMethod returns the method actually sent for the one returned by
+// to0RTTMethod
+func from0RTTMethod(method string) string {
+	switch method {
+	case http3.MethodGet0RTT:
+		return http.MethodGet
+	case http3.MethodHead0RTT:
+		return http.MethodHead
+	}
+	return method
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/h2quic"
+)
+
+// gquicSessionTracker records the last session dialed by the gQUIC client,
+// since the h2quic doesn't fill the TLS field of the response
+type gquicSessionTracker struct {
+	lock sync.Mutex
+	sess quic.Session
+}
+
+func trackGQUICSession(hclient *http.Client) *gquicSessionTracker {
+	tracker := &gquicSessionTracker{}
+
+	rt := hclient.Transport
+	if frt, ok := rt.(*fallbackRoundTripper); ok {
+		rt = frt.quicRT
+	}
+	if h2rt, ok := rt.(*h2quic.RoundTripper); ok {
+		dial := h2rt.Dial
+		h2rt.Dial = func(network, addr string, tlsCfg *tls.Config,
+			cfg *quic.Config) (quic.Session, error) {
+
+			sess, err := dial(network, addr, tlsCfg, cfg)
+			if err == nil {
+				tracker.lock.Lock()
+				tracker.sess = sess
+				tracker.lock.Unlock()
+			}
+			return sess, err
+		}
+	}
+	return tracker
+}
+
+func (t *gquicSessionTracker) peerCertificates() []*x509.Certificate {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.sess == nil {
+		return nil
+	}
+	return t.sess.ConnectionState().PeerCertificates
+}
+
+func describePublicKey(pub interface{}) string {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", pub.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return "unknown"
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+func subjectAltNames(cert *x509.Certificate) string {
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		names = append(names, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, "URI:"+uri.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// printCertInfo prints the certificate chain presented by the server. The
+// state is nil if the connection doesn't use TLS, like gQUIC.
+func printCertInfo(w io.Writer, state *tls.ConnectionState, certs []*x509.Certificate,
+	host string) {
+
+	if state != nil {
+		fmt.Fprintf(w, "TLS version: %s\n", tls.VersionName(state.Version))
+		fmt.Fprintf(w, "Cipher suite: %s\n", tls.CipherSuiteName(state.CipherSuite))
+		fmt.Fprintf(w, "ALPN: %s\n", state.NegotiatedProtocol)
+	} else {
+		fmt.Fprintln(w, "TLS version: none, gQUIC crypto is used")
+	}
+
+	if len(certs) > 0 {
+		matched := "no"
+		if certs[0].VerifyHostname(host) == nil {
+			matched = "yes"
+		}
+		fmt.Fprintf(w, "SNI %s matched the certificate: %s\n", host, matched)
+	}
+
+	const timeFmt = "2006-01-02 15:04:05 MST"
+	fmt.Fprintln(w, "Certificate chain:")
+	for i, cert := range certs {
+		fmt.Fprintf(w, "%2d Subject: %s\n", i, cert.Subject)
+		fmt.Fprintf(w, "   Issuer: %s\n", cert.Issuer)
+		fmt.Fprintf(w, "   SANs: %s\n", subjectAltNames(cert))
+		fmt.Fprintf(w, "   Validity: %s - %s\n", cert.NotBefore.UTC().Format(timeFmt),
+			cert.NotAfter.UTC().Format(timeFmt))
+		fmt.Fprintf(w, "   Key: %s\n", describePublicKey(cert.PublicKey))
+		fmt.Fprintf(w, "   SHA-256 fingerprint: %s\n", fingerprint(cert))
+	}
+}
+
+func exportCertChain(fn string, certs []*x509.Certificate) error {
+	f, err := openFileToWrite(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, cert := range certs {
+		err = pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// showCert prints the certificate chain presented by the server which sent
+// the resp to stderr, and exports it if -export-cert is given
+func showCert(w io.Writer, resp *http.Response, tracker *gquicSessionTracker) error {
+	state := resp.TLS
+	var certs []*x509.Certificate
+	if state != nil {
+		certs = state.PeerCertificates
+	} else if tracker != nil {
+		certs = tracker.peerCertificates()
+	}
+
+	// the SNI is not sent if the host is an IP address, check it instead
+	host := config.sni
+	if host == "" {
+		host = resp.Request.URL.Hostname()
+	}
+
+	if config.showCert {
+		printCertInfo(w, state, certs, host)
+	}
+	if config.exportCert != "" {
+		return exportCertChain(config.exportCert, certs)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintCertInfo(t *testing.T) {
+	leaf, err := x509.ParseCertificate(tlsCfg.Certificates[0].Certificate[0])
+	assert.Nil(t, err)
+
+	b := &bytes.Buffer{}
+	state := &tls.ConnectionState{
+		Version:            tls.VersionTLS13,
+		CipherSuite:        tls.TLS_AES_128_GCM_SHA256,
+		NegotiatedProtocol: "h3",
+	}
+	printCertInfo(b, state, []*x509.Certificate{leaf}, "www.test.com")
+	output := b.String()
+	assert.Contains(t, output, "TLS version: TLS 1.3\nCipher suite: TLS_AES_128_GCM_SHA256\nALPN: h3\n")
+	assert.Contains(t, output, "SNI www.test.com matched the certificate: yes\n")
+	assert.Contains(t, output, " 0 Subject: \n   Issuer: \n")
+	assert.Contains(t, output, "   SANs: DNS:www.test.com, IP:127.0.0.1\n")
+	assert.Contains(t, output, "   Key: RSA 1024 bits\n")
+	assert.Regexp(t, `   SHA-256 fingerprint: ([0-9A-F]{2}:){31}[0-9A-F]{2}\n`, output)
+
+	b.Reset()
+	printCertInfo(b, nil, []*x509.Certificate{leaf}, "www.example.com")
+	output = b.String()
+	assert.Contains(t, output, "TLS version: none, gQUIC crypto is used\n")
+	assert.Contains(t, output, "SNI www.example.com matched the certificate: no\n")
+}
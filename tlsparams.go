@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+
+	iquic "github.com/quic-go/quic-go"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// the names of the curves, same as the ones used by curl
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":             tls.X25519,
+	"P-256":              tls.CurveP256,
+	"P-384":              tls.CurveP384,
+	"P-521":              tls.CurveP521,
+	"X25519MLKEM768":     tls.X25519MLKEM768,
+	"SecP256r1MLKEM768":  tls.SecP256r1MLKEM768,
+	"SecP384r1MLKEM1024": tls.SecP384r1MLKEM1024,
+}
+
+func sortedNames(m interface{}) string {
+	var names []string
+	switch m := m.(type) {
+	case map[string]uint16:
+		for name := range m {
+			names = append(names, name)
+		}
+	case map[string]tls.CurveID:
+		for name := range m {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// splitList splits the list separated by ':' or ',', like the one used by
+// OpenSSL
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ':' || r == ','
+	})
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	v, found := tlsVersions[s]
+	if !found {
+		return 0, fmt.Errorf("unknown TLS version %s, valid versions: %s",
+			s, sortedNames(tlsVersions))
+	}
+	return v, nil
+}
+
+// parseCipherSuites parses the TLS 1.2 cipher suites, as the TLS 1.3 ones are
+// not configurable in crypto/tls
+func parseCipherSuites(s string) ([]uint16, error) {
+	valid := map[string]uint16{}
+	tls13 := map[string]bool{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+			tls13[cs.Name] = true
+		} else {
+			valid[cs.Name] = cs.ID
+		}
+	}
+
+	var ids []uint16
+	for _, name := range splitList(s) {
+		if tls13[name] {
+			return nil, fmt.Errorf("TLS 1.3 cipher suite %s is not configurable", name)
+		}
+		id, found := valid[name]
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite %s, valid cipher suites: %s",
+				name, sortedNames(valid))
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no cipher suite given")
+	}
+	return ids, nil
+}
+
+func parseCurves(s string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range splitList(s) {
+		curve, found := tlsCurves[name]
+		if !found {
+			return nil, fmt.Errorf("unknown curve %s, valid curves: %s",
+				name, sortedNames(tlsCurves))
+		}
+		curves = append(curves, curve)
+	}
+	if len(curves) == 0 {
+		return nil, errors.New("no curve given")
+	}
+	return curves, nil
+}
+
+const (
+	alertHandshakeFailure     = 40
+	alertProtocolVersion      = 70
+	alertInsufficientSecurity = 71
+	// the QUIC crypto error code is 0x100 + TLS alert
+	quicCryptoErrorBase = 0x100
+)
+
+// tlsAlertOf returns the TLS alert sent by the server which fails the
+// handshake. The alerts raised locally are not the rejection of the server.
+func tlsAlertOf(err error) (uint8, bool) {
+	var transportErr *iquic.TransportError
+	if errors.As(err, &transportErr) {
+		if !transportErr.Remote || !transportErr.ErrorCode.IsCryptoError() {
+			return 0, false
+		}
+		return uint8(transportErr.ErrorCode - quicCryptoErrorBase), true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" && opErr.Err != nil {
+		// the type of alert sent by the peer is not exported, but it has the
+		// same message as tls.AlertError
+		msg := opErr.Err.Error()
+		for alert := 0; alert <= math.MaxUint8; alert++ {
+			if tls.AlertError(alert).Error() == msg {
+				return uint8(alert), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// explainHandshakeError names the TLS parameters restricted by the options,
+// which may be the reason why the handshake fails
+func explainHandshakeError(err error) error {
+	alert, ok := tlsAlertOf(err)
+	if !ok {
+		return err
+	}
+
+	var params []string
+	if config.rawTLSMax != "" && alert != alertHandshakeFailure &&
+		alert != alertInsufficientSecurity {
+
+		params = append(params, "-tls-max "+config.rawTLSMax)
+	}
+	if alert != alertProtocolVersion {
+		if config.rawCiphers != "" {
+			params = append(params, "-ciphers "+config.rawCiphers)
+		}
+		if config.rawCurves != "" {
+			params = append(params, "-curves "+config.rawCurves)
+		}
+	}
+	if len(params) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w (the TLS parameters may be rejected: %s)",
+		err, strings.Join(params, ", "))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	iquic "github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTLSParams(t *testing.T) {
+	v, err := parseTLSVersion("1.2")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), v)
+	_, err = parseTLSVersion("1.1")
+	assert.Equal(t, "unknown TLS version 1.1, valid versions: 1.2, 1.3", err.Error())
+
+	ciphers, err := parseCipherSuites(
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:TLS_RSA_WITH_AES_128_CBC_SHA")
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA}, ciphers)
+	_, err = parseCipherSuites("TLS_AES_128_GCM_SHA256")
+	assert.Equal(t, "TLS 1.3 cipher suite TLS_AES_128_GCM_SHA256 is not configurable",
+		err.Error())
+	_, err = parseCipherSuites("RC4")
+	assert.Regexp(t, "^unknown cipher suite RC4, valid cipher suites: .*TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		err.Error())
+	_, err = parseCipherSuites(":")
+	assert.Equal(t, "no cipher suite given", err.Error())
+
+	curves, err := parseCurves("X25519,P-256")
+	assert.Nil(t, err)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, curves)
+	_, err = parseCurves("P-192")
+	assert.Equal(t, "unknown curve P-192, valid curves: P-256, P-384, P-521, "+
+		"SecP256r1MLKEM768, SecP384r1MLKEM1024, X25519, X25519MLKEM768", err.Error())
+}
+
+// testAlert mimics the unexported alert type of crypto/tls
+type testAlert uint8
+
+func (a testAlert) Error() string {
+	return tls.AlertError(a).Error()
+}
+
+func TestExplainHandshakeError(t *testing.T) {
+	defer resetArgs()
+	config.rawTLSMax = "1.2"
+	config.rawCurves = "X25519"
+
+	err := explainHandshakeError(&iquic.TransportError{
+		Remote:    true,
+		ErrorCode: iquic.TransportErrorCode(0x100 + alertProtocolVersion),
+	})
+	assert.Regexp(t, `\(the TLS parameters may be rejected: -tls-max 1.2\)$`, err.Error())
+	err = explainHandshakeError(&iquic.TransportError{
+		Remote:    true,
+		ErrorCode: iquic.TransportErrorCode(0x100 + alertHandshakeFailure),
+	})
+	assert.Regexp(t, `\(the TLS parameters may be rejected: -curves X25519\)$`, err.Error())
+	err = explainHandshakeError(&net.OpError{Op: "remote error", Err: testAlert(80)})
+	assert.Regexp(t, `\(the TLS parameters may be rejected: -tls-max 1.2, -curves X25519\)$`,
+		err.Error())
+
+	// the alerts raised locally are not sent to the server
+	localErr := &iquic.TransportError{
+		ErrorCode: iquic.TransportErrorCode(0x100 + alertProtocolVersion),
+	}
+	assert.Equal(t, localErr, explainHandshakeError(localErr))
+	assert.Equal(t, tls.AlertError(80), explainHandshakeError(tls.AlertError(80)))
+
+	timeout := errors.New("connect timeout")
+	assert.Equal(t, timeout, explainHandshakeError(timeout))
+	// the error is not caused by TLS
+	err = explainHandshakeError(&net.OpError{Op: "dial", Err: timeout})
+	assert.Equal(t, "dial: connect timeout", err.Error())
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"time"
 
+	quic "github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/h2quic"
+	iquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 )
 
 const (
@@ -44,6 +49,10 @@ var (
 )
 
 func startServer(handler http.Handler) chan struct{} {
+	return startServerWithQUICConfig(handler, nil)
+}
+
+func startServerWithQUICConfig(handler http.Handler, quicConf *quic.Config) chan struct{} {
 	done := make(chan struct{})
 	go func() {
 		netAddr, err := url.Parse(addrListened)
@@ -56,6 +65,7 @@ func startServer(handler http.Handler) chan struct{} {
 				Addr:    netAddr.Host,
 				Handler: handler,
 			},
+			QuicConfig: quicConf,
 		}
 		server.TLSConfig = tlsCfg
 
@@ -75,3 +85,92 @@ func startServer(handler http.Handler) chan struct{} {
 
 	return done
 }
+
+func startH3Server(handler http.Handler) chan struct{} {
+	return startH3ServerWithQUICConfig(handler, nil)
+}
+
+func startH3ServerWithQUICConfig(handler http.Handler, quicConf *iquic.Config) chan struct{} {
+	return startH3ServerWithConfig(handler, tlsCfg.Clone(), quicConf)
+}
+
+func startH3ServerWithConfig(handler http.Handler, tlsConf *tls.Config,
+	quicConf *iquic.Config) chan struct{} {
+
+	done := make(chan struct{})
+	go func() {
+		netAddr, err := url.Parse(addrListened)
+		if err != nil {
+			panic(err)
+		}
+
+		conn, err := net.ListenPacket("udp", netAddr.Host)
+		if err != nil {
+			panic(err)
+		}
+
+		server := &http3.Server{
+			Handler:    handler,
+			TLSConfig:  http3.ConfigureTLSConfig(tlsConf),
+			QUICConfig: quicConf,
+		}
+
+		go func() {
+			server.Serve(conn)
+		}()
+		<-done
+		err = server.Close()
+		if err != nil {
+			panic(err)
+		}
+		// the server doesn't close the connection passed to Serve
+		conn.Close()
+		close(done)
+	}()
+
+	// ensure server is started
+	time.Sleep(50 * time.Millisecond)
+
+	return done
+}
+
+// startTCPServer starts a HTTPS server over TCP, which listens on the same
+// port as the QUIC one
+func startTCPServer(handler http.Handler) chan struct{} {
+	return startTCPServerWithTLSConfig(handler, tlsCfg.Clone())
+}
+
+func startTCPServerWithTLSConfig(handler http.Handler, tlsConf *tls.Config) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		netAddr, err := url.Parse(addrListened)
+		if err != nil {
+			panic(err)
+		}
+
+		ln, err := net.Listen("tcp", netAddr.Host)
+		if err != nil {
+			panic(err)
+		}
+
+		server := &http.Server{
+			Handler:   handler,
+			TLSConfig: tlsConf,
+		}
+
+		go func() {
+			server.ServeTLS(ln, "", "")
+		}()
+		<-done
+		err = server.Close()
+		if err != nil {
+			panic(err)
+		}
+		close(done)
+	}()
+
+	// ensure server is started
+	time.Sleep(50 * time.Millisecond)
+
+	return done
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	// the output of -v, stdout is left for the response body
+	verboseOut  io.Writer = os.Stderr
+	verboseLock sync.Mutex
+)
+
+// verbosef prints the connection events like curl's '*' lines if -v is given
+func verbosef(format string, a ...interface{}) {
+	if !config.verbose {
+		return
+	}
+	verboseLock.Lock()
+	fmt.Fprintf(verboseOut, "* "+format+"\n", a...)
+	verboseLock.Unlock()
+}
+
+func printHeaders(prefix string, hdr http.Header) {
+	keys := make([]string, 0, len(hdr))
+	for k := range hdr {
+		keys = append(keys, k)
+	}
+	// make the output reproducible
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "Host" {
+			// the Host header is ignored, req.Host is sent instead
+			continue
+		}
+		for _, v := range hdr[k] {
+			fmt.Fprintf(verboseOut, "%s%s: %s\n", prefix, k, v)
+		}
+	}
+}
+
+// sniOf returns the SNI which will be sent when dialing the addr
+func sniOf(addr, serverName string) string {
+	if serverName != "" {
+		return serverName
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return host
+}
+
+// verboseRoundTripper prints the requests as sent, with the cookies from the
+// jar applied, and the responses received. The request is printed after the
+// round trip, since the protocol is unknown until then: the request may be
+// sent over TCP once it fails to connect via QUIC.
+type verboseRoundTripper struct {
+	rt http.RoundTripper
+}
+
+// formatProto formats the protocol of the response like curl, i.e. HTTP/2
+// instead of HTTP/2.0
+func formatProto(resp *http.Response) string {
+	if resp.ProtoMajor >= 2 {
+		return fmt.Sprintf("HTTP/%d", resp.ProtoMajor)
+	}
+	return resp.Proto
+}
+
+func printReq(req *http.Request, proto string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	reqLine := from0RTTMethod(req.Method) + " " + req.URL.RequestURI()
+	if proto != "" {
+		reqLine += " " + proto
+	}
+	fmt.Fprintf(verboseOut, "> %s\n", reqLine)
+	fmt.Fprintf(verboseOut, "> Host: %s\n", host)
+	printHeaders("> ", req.Header)
+	fmt.Fprintln(verboseOut, ">")
+}
+
+func (vrt *verboseRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := vrt.rt.RoundTrip(req)
+
+	verboseLock.Lock()
+	defer verboseLock.Unlock()
+	if err != nil {
+		// the protocol is unknown if no response is received
+		printReq(req, "")
+		return resp, err
+	}
+
+	printReq(req, formatProto(resp))
+	fmt.Fprintf(verboseOut, "< %s %s\n", resp.Proto, resp.Status)
+	printHeaders("< ", resp.Header)
+	fmt.Fprintln(verboseOut, "<")
+	return resp, nil
+}
+
+func (vrt *verboseRoundTripper) Close() error {
+	destroyClient(&http.Client{Transport: vrt.rt})
+	return nil
+}
+
+// verboseJar prints the cookies stored into the jar
+type verboseJar struct {
+	http.CookieJar
+}
+
+func (j *verboseJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	for _, c := range cookies {
+		verbosef("Cookie stored for %s: %s", u.Host, c.String())
+	}
+	j.CookieJar.SetCookies(u, cookies)
+}
+
+// enableVerbose makes the client print the requests, responses and cookies.
+// It should be called after all the other hooks are installed, since it
+// wraps the transport.
+func enableVerbose(hclient *http.Client) {
+	hclient.Transport = &verboseRoundTripper{rt: hclient.Transport}
+	if hclient.Jar != nil {
+		hclient.Jar = &verboseJar{hclient.Jar}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// loadCertPool creates a pool which only contains the CA certificates in the
+// caFile and the files under the caPath, instead of the system ones
+func loadCertPool(caFile, caPath string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+
+	if caPath != "" {
+		files, err := ioutil.ReadDir(caPath)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, fi := range files {
+			if fi.IsDir() {
+				continue
+			}
+			// the files which are not PEM, like the README, are skipped
+			data, err := ioutil.ReadFile(filepath.Join(caPath, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if pool.AppendCertsFromPEM(data) {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no certificate found in %s", caPath)
+		}
+	}
+	return pool, nil
+}
+
+// parsePinnedPubKey parses the hashes in the format like curl:
+// "sha256//base64[;sha256//base64...]"
+func parsePinnedPubKey(s string) ([][]byte, error) {
+	var hashes [][]byte
+	for _, pin := range strings.Split(s, ";") {
+		pin = strings.TrimSpace(pin)
+		if !strings.HasPrefix(pin, "sha256//") {
+			return nil, fmt.Errorf("%s should be in the format sha256//base64", pin)
+		}
+		hash, err := base64.StdEncoding.DecodeString(pin[len("sha256//"):])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", pin, err.Error())
+		}
+		if len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%s: wrong length of the sha256 hash", pin)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+var errPinnedPubKeyMismatched = errors.New("public key does not match pinned public key")
+
+// verifyPinnedPubKey checks the SPKI hash of the server's leaf certificate.
+// Like curl, it is checked even if -k is given.
+func verifyPinnedPubKey(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	certs := make([]*x509.Certificate, 0, 1)
+	if len(rawCerts) > 0 {
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		certs = append(certs, leaf)
+	}
+	return checkPinnedPubKey(certs)
+}
+
+func checkPinnedPubKey(certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errPinnedPubKeyMismatched
+	}
+	hash := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	for _, pinned := range config.pinnedPubKeys {
+		if string(pinned) == string(hash[:]) {
+			return nil
+		}
+	}
+	verbosef("Public key hash of the server: sha256//%s",
+		base64.StdEncoding.EncodeToString(hash[:]))
+	return errPinnedPubKeyMismatched
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/pem"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePinnedPubKey(t *testing.T) {
+	hashes, err := parsePinnedPubKey(
+		"sha256//YhKJKSzoTt2b5FP18fvpHo7fJYqQCjAa3HWY3tvRMwE=; sha256//AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(hashes))
+
+	_, err = parsePinnedPubKey("YhKJKSzoTt2b5FP18fvpHo7fJYqQCjAa3HWY3tvRMwE=")
+	assert.Equal(t, "YhKJKSzoTt2b5FP18fvpHo7fJYqQCjAa3HWY3tvRMwE= should be in the format sha256//base64",
+		err.Error())
+	_, err = parsePinnedPubKey("sha256//AAAA")
+	assert.Equal(t, "sha256//AAAA: wrong length of the sha256 hash", err.Error())
+	_, err = parsePinnedPubKey("sha256//!!")
+	assert.NotNil(t, err)
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := createTmpDir()
+	defer os.RemoveAll(dir)
+
+	certDER, _ := generateClientCert("ca")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	caFile := writeFile(dir, "ca.pem", certPEM)
+	writeFile(dir, "README", []byte("not a certificate"))
+
+	pool, err := loadCertPool(caFile, "")
+	assert.Nil(t, err)
+	assert.NotNil(t, pool)
+	pool, err = loadCertPool("", dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, pool)
+
+	emptyDir := createTmpDir()
+	defer os.RemoveAll(emptyDir)
+	_, err = loadCertPool("", emptyDir)
+	assert.Equal(t, "no certificate found in "+emptyDir, err.Error())
+	readme := writeFile(emptyDir, "README", []byte("not a certificate"))
+	_, err = loadCertPool(readme, "")
+	assert.Equal(t, "no certificate found in "+readme, err.Error())
+}
@@ -4,6 +4,8 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 // VersionNumber is a version number as int
@@ -11,7 +13,8 @@ type VersionNumber uint32
 
 // gQUIC version range as defined in the wiki: https://github.com/quicwg/base-drafts/wiki/QUIC-Versions
 const (
-	gquicVersion0 = 0x51303030
+	gquicVersion0   = 0x51303030
+	maxGquicVersion = 0x51303439
 )
 
 // The version numbers, making grepping easier
@@ -19,20 +22,108 @@ const (
 	Version39 VersionNumber = gquicVersion0 + 3*0x100 + 0x9
 	Version43 VersionNumber = gquicVersion0 + 4*0x100 + 0x3
 	Version44 VersionNumber = gquicVersion0 + 4*0x100 + 0x4
+
+	// Version1 is RFC 9000
+	Version1 VersionNumber = 0x1
+	// Version2 is RFC 9369
+	Version2 VersionNumber = 0x6b3343cf
+	// VersionDraft29 is only used to name the version, it is not supported
+	VersionDraft29 VersionNumber = 0xff00001d
 )
 
-// SupportedVersions lists the versions that the server supports
-// must be in sorted descending order
+// SupportedVersions lists the versions that the client supports.
+// The IETF QUIC versions come first, then the gQUIC versions
+// in sorted descending order
 var SupportedVersions = []VersionNumber{
+	Version1,
+	Version2,
 	Version44,
 	Version43,
 	Version39,
 }
 
 func (vn VersionNumber) String() string {
-	return fmt.Sprintf("gQUIC %d", vn.toGQUICVersion())
+	switch vn {
+	case Version1:
+		return "QUIC v1"
+	case Version2:
+		return "QUIC v2"
+	case VersionDraft29:
+		return "QUIC draft-29"
+	}
+	if vn.isGQUIC() {
+		return fmt.Sprintf("gQUIC %d", vn.toGQUICVersion())
+	}
+	return fmt.Sprintf("%#x", uint32(vn))
+}
+
+// isGQUIC says if this is a gQUIC version, which is served via the h2quic
+// stack instead of HTTP/3
+func (vn VersionNumber) isGQUIC() bool {
+	return vn > gquicVersion0 && vn <= maxGquicVersion
 }
 
 func (vn VersionNumber) toGQUICVersion() int {
 	return int(10*(vn-gquicVersion0)/0x100) + int(vn%0x10)
 }
+
+// isReserved says if this is a version reserved for greasing, see RFC 9000
+// section 15
+func (vn VersionNumber) isReserved() bool {
+	return vn&0x0f0f0f0f == 0x0a0a0a0a
+}
+
+func isSupportedVersion(vn VersionNumber) bool {
+	for _, v := range SupportedVersions {
+		if v == vn {
+			return true
+		}
+	}
+	return false
+}
+
+// formatVersions joins the versions with ", ", skipping the reserved ones
+func formatVersions(versions []VersionNumber) string {
+	names := make([]string, 0, len(versions))
+	for _, v := range versions {
+		if !v.isReserved() {
+			names = append(names, v.String())
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// parseVersion parses version names like "gQUIC 43", "Q043", "v1", "QUIC v2",
+// "h3" or "h3-29". The name is case insensitive.
+func parseVersion(name string) (VersionNumber, error) {
+	s := strings.ToLower(strings.Replace(name, " ", "", -1))
+	var vn VersionNumber
+	switch s {
+	case "v1", "quicv1", "h3":
+		vn = Version1
+	case "v2", "quicv2":
+		vn = Version2
+	case "h3-29", "draft-29", "quicdraft-29":
+		vn = VersionDraft29
+	default:
+		var num string
+		if strings.HasPrefix(s, "gquic") {
+			num = s[len("gquic"):]
+		} else if strings.HasPrefix(s, "q0") {
+			num = s[len("q"):]
+		}
+		if n, err := strconv.Atoi(num); err == nil && 0 < n && n < 100 {
+			vn = VersionNumber(gquicVersion0 + n/10*0x100 + n%10)
+		}
+	}
+
+	if vn == 0 {
+		return 0, fmt.Errorf("unknown QUIC version %s, supported versions: %s",
+			name, formatVersions(SupportedVersions))
+	}
+	if !isSupportedVersion(vn) {
+		return 0, fmt.Errorf("%s is not supported, supported versions: %s",
+			vn, formatVersions(SupportedVersions))
+	}
+	return vn, nil
+}
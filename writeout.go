@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	iquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// writeOutInfo collects the values used by -w. The times are relative to the
+// start of the operation.
+type writeOutInfo struct {
+	lock  sync.Mutex
+	start time.Time
+	// the handshakes not completed after the 0-RTT dial
+	handshakes sync.WaitGroup
+
+	timeNameLookup    time.Duration
+	timeConnect       time.Duration
+	timeStartTransfer time.Duration
+	timeTotal         time.Duration
+
+	httpCode     int
+	sizeDownload int64
+	remoteIP     string
+	quicVersion  VersionNumber
+	numRedirects int
+	urlEffective string
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 6, 64)
+}
+
+// writeOutVars maps the variables supported by -w to their values
+var writeOutVars = map[string]func(wo *writeOutInfo) string{
+	"time_namelookup": func(wo *writeOutInfo) string {
+		return formatSeconds(wo.timeNameLookup)
+	},
+	// QUIC doesn't have a separate connect step, the connection is established
+	// after the handshake
+	"time_connect": func(wo *writeOutInfo) string {
+		return formatSeconds(wo.timeConnect)
+	},
+	"time_appconnect": func(wo *writeOutInfo) string {
+		return formatSeconds(wo.timeConnect)
+	},
+	"time_starttransfer": func(wo *writeOutInfo) string {
+		return formatSeconds(wo.timeStartTransfer)
+	},
+	"time_total": func(wo *writeOutInfo) string {
+		return formatSeconds(wo.timeTotal)
+	},
+	"http_code": func(wo *writeOutInfo) string {
+		return fmt.Sprintf("%03d", wo.httpCode)
+	},
+	"size_download": func(wo *writeOutInfo) string {
+		return strconv.FormatInt(wo.sizeDownload, 10)
+	},
+	"remote_ip": func(wo *writeOutInfo) string {
+		return wo.remoteIP
+	},
+	"quic_version": func(wo *writeOutInfo) string {
+		if wo.quicVersion == 0 {
+			return ""
+		}
+		return wo.quicVersion.String()
+	},
+	"num_redirects": func(wo *writeOutInfo) string {
+		return strconv.Itoa(wo.numRedirects)
+	},
+	"url_effective": func(wo *writeOutInfo) string {
+		return wo.urlEffective
+	},
+}
+
+// expandWriteOut replaces the %{variable} in the format with the value
+// returned by the expand. Like curl, "%%" means "%", and "\n", "\r" and "\t"
+// are unescaped.
+func expandWriteOut(format string, expand func(name string) string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if i+1 == len(format) {
+			b.WriteByte(c)
+			break
+		}
+
+		switch c {
+		case '%':
+			next := format[i+1]
+			if next == '%' {
+				b.WriteByte('%')
+				i++
+			} else if next == '{' {
+				end := strings.IndexByte(format[i:], '}')
+				if end == -1 {
+					return "", fmt.Errorf("unclosed variable %s", format[i:])
+				}
+				name := format[i+2 : i+end]
+				if _, found := writeOutVars[name]; !found {
+					return "", fmt.Errorf("unknown variable %%{%s}", name)
+				}
+				b.WriteString(expand(name))
+				i += end
+			} else {
+				b.WriteByte(c)
+			}
+		case '\\':
+			switch format[i+1] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(c)
+				continue
+			}
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func checkWriteOut(format string) error {
+	_, err := expandWriteOut(format, func(name string) string { return "" })
+	return err
+}
+
+func newWriteOutInfo() *writeOutInfo {
+	return &writeOutInfo{
+		start: time.Now(),
+	}
+}
+
+// reset clears the values for the next request. The connection may be reused,
+// in which case the times of name lookup and connect are zero.
+func (wo *writeOutInfo) reset() {
+	wo.lock.Lock()
+	defer wo.lock.Unlock()
+
+	wo.start = time.Now()
+	wo.timeNameLookup = 0
+	wo.timeConnect = 0
+	wo.timeStartTransfer = 0
+	wo.timeTotal = 0
+	wo.httpCode = 0
+	wo.sizeDownload = 0
+	wo.numRedirects = 0
+	wo.urlEffective = ""
+}
+
+// resolved is called by the dial once the address is resolved
+func (wo *writeOutInfo) resolved() {
+	wo.lock.Lock()
+	defer wo.lock.Unlock()
+
+	wo.timeNameLookup = time.Since(wo.start)
+}
+
+func (wo *writeOutInfo) connected(remoteAddr net.Addr, vn VersionNumber) {
+	wo.lock.Lock()
+	defer wo.lock.Unlock()
+
+	wo.timeConnect = time.Since(wo.start)
+	if udpAddr, ok := remoteAddr.(*net.UDPAddr); ok {
+		wo.remoteIP = udpAddr.IP.String()
+	}
+	wo.quicVersion = vn
+}
+
+// hookClient wraps the Dial of HTTP/3 and CheckRedirect of the client to
+// collect the values. The time of name lookup and the gQUIC session are
+// collected via the dialTrace given to createTracedClient.
+func (wo *writeOutInfo) hookClient(hclient *http.Client) {
+	rt := hclient.Transport
+	if frt, ok := rt.(*fallbackRoundTripper); ok {
+		rt = frt.quicRT
+	}
+
+	if rt, ok := rt.(*http3.Transport); ok {
+		dial := rt.Dial
+		rt.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config,
+			cfg *iquic.Config) (*iquic.Conn, error) {
+
+			conn, err := dial(ctx, addr, tlsCfg, cfg)
+			if err != nil {
+				return nil, err
+			}
+			select {
+			case <-conn.HandshakeComplete():
+				wo.connected(conn.RemoteAddr(),
+					VersionNumber(conn.ConnectionState().Version))
+			default:
+				// the handshake is not completed yet if 0-RTT is used
+				wo.handshakes.Add(1)
+				go func() {
+					defer wo.handshakes.Done()
+					select {
+					case <-conn.HandshakeComplete():
+						wo.connected(conn.RemoteAddr(),
+							VersionNumber(conn.ConnectionState().Version))
+					case <-conn.Context().Done():
+					}
+				}()
+			}
+			return conn, nil
+		}
+	}
+
+	checkRedirect := hclient.CheckRedirect
+	hclient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		err := checkRedirect(req, via)
+		if err == nil {
+			wo.lock.Lock()
+			wo.numRedirects = len(via)
+			wo.lock.Unlock()
+		}
+		return err
+	}
+}
+
+type countingReader struct {
+	rc io.ReadCloser
+	n  *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	*r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	return r.rc.Close()
+}
+
+// gotResp records the response and counts the size of its body
+func (wo *writeOutInfo) gotResp(resp *http.Response) {
+	wo.lock.Lock()
+	defer wo.lock.Unlock()
+
+	wo.timeStartTransfer = time.Since(wo.start)
+	wo.httpCode = resp.StatusCode
+	u := *resp.Request.URL
+	if resp.Request.Host != "" {
+		u.Host = resp.Request.Host
+	}
+	wo.urlEffective = u.String()
+	resp.Body = &countingReader{rc: resp.Body, n: &wo.sizeDownload}
+}
+
+// write writes the format with the variables expanded to the out
+func (wo *writeOutInfo) write(out io.Writer, format string) error {
+	wo.handshakes.Wait()
+	wo.lock.Lock()
+	defer wo.lock.Unlock()
+
+	wo.timeTotal = time.Since(wo.start)
+	s, err := expandWriteOut(format, func(name string) string {
+		return writeOutVars[name](wo)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, s)
+	return err
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandWriteOut(t *testing.T) {
+	expand := func(name string) string { return "<" + name + ">" }
+
+	s, err := expandWriteOut(`%{http_code}\t%{size_download}\n100%% %x\q`, expand)
+	assert.Nil(t, err)
+	assert.Equal(t, "<http_code>\t<size_download>\n100% %x\\q", s)
+
+	s, err = expandWriteOut("%", expand)
+	assert.Nil(t, err)
+	assert.Equal(t, "%", s)
+
+	_, err = expandWriteOut("%{http_code", expand)
+	assert.Equal(t, "unclosed variable %{http_code", err.Error())
+	_, err = expandWriteOut("%{xxx}", expand)
+	assert.Equal(t, "unknown variable %{xxx}", err.Error())
+}